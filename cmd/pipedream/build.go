@@ -0,0 +1,37 @@
+package main
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/uber-go/zap"
+)
+
+var buildCmd = cobra.Command{
+	Use:   "build",
+	Short: "Precompile all assets into the output directory",
+	Run:   buildCmdCobra,
+}
+
+func buildCmdCobra(cmd *cobra.Command, args []string) {
+	log.Info("building assets", zap.String("in", pipeline.In), zap.String("out", pipeline.Out))
+
+	results, err := pipeline.CompileContext(interruptContext())
+	for _, r := range results {
+		if r.Err != nil {
+			log.Error("failed to compile", zap.String("file", r.Source), zap.Error(r.Err))
+			continue
+		}
+
+		if r.Cached {
+			log.Info("unchanged", zap.String("asset", r.Asset), zap.String("output", r.Output))
+			continue
+		}
+
+		log.Info("compiled", zap.String("asset", r.Asset), zap.String("output", r.Output))
+	}
+
+	if err != nil {
+		log.Fatal("build failed", zap.Error(err))
+	}
+
+	log.Info("build complete", zap.Int("assets", len(results)))
+}
@@ -1,12 +1,13 @@
 package main
 
 import (
+	"context"
 	"os"
+	"os/signal"
 	"reflect"
 	"strconv"
 	"strings"
 
-	"github.com/BurntSushi/toml"
 	"github.com/aarondl/zapcolors"
 	"github.com/davecgh/go-spew/spew"
 	"github.com/nullbio/pipedream"
@@ -31,6 +32,8 @@ var (
 
 	pipeline pipedream.Pipedream
 
+	flags *pflag.FlagSet
+
 	flagNoColor bool
 	flagConfig  string
 
@@ -41,10 +44,18 @@ var (
 	flagNoMinify   bool
 	flagNoHash     bool
 	flagNoCompress bool
+	flagBrotli     bool
+	flagZstd       bool
+	flagMinSize    int
+	flagUnhashedCC string
+	flagJobs       int
+
+	flagFingerprintHash string
+	flagIntegrityHash   string
 )
 
 func main() {
-	flags := rootCmd.PersistentFlags()
+	flags = rootCmd.PersistentFlags()
 	flags.BoolVarP(&flagNoColor, "no-color", "", false, "No color output")
 	flags.StringVarP(&flagConfig, "config", "c", "", "Path to a configuration file")
 
@@ -55,8 +66,23 @@ func main() {
 
 	flags.BoolVarP(&flagNoCompile, "no-compile", "", false, "Don't run assets through compilers")
 	flags.BoolVarP(&flagNoMinify, "no-minify", "", false, "Don't run assets through minifiers")
-	flags.BoolVarP(&flagNoHash, "no-hash", "", false, "Don't fingerprint the end result, also disables manifest generation")
-	flags.BoolVarP(&flagNoCompress, "no-compress", "", false, "Don't generate .gz copies of the files")
+	flags.BoolVarP(&flagNoHash, "no-hash", "", false, "Don't fingerprint the end result")
+	flags.BoolVarP(&flagNoCompress, "no-compress", "", false, "Don't generate compressed copies of the files")
+	flags.BoolVarP(&flagBrotli, "brotli", "", false, "Generate .br copies of the files as well as .gz")
+	flags.BoolVarP(&flagZstd, "zstd", "", false, "Generate .zst copies of the files as well as .gz")
+	flags.IntVarP(&flagMinSize, "compress-min-size", "", 0, "Don't compress files smaller than this many bytes")
+	flags.StringVarP(&flagUnhashedCC, "unhashed-cache-control", "", "", "Cache-Control header served for files when not fingerprinting")
+	flags.StringVarP(&flagFingerprintHash, "fingerprint-hash", "", "", "Hash used to fingerprint file names: md5, sha1, sha256, sha384 or sha512 (default md5)")
+	flags.StringVarP(&flagIntegrityHash, "integrity-hash", "", "", "Hash used for Subresource Integrity: sha256, sha384 or sha512 (default sha384)")
+	flags.IntVarP(&flagJobs, "jobs", "j", 0, "How many files to compile concurrently (default number of CPUs)")
+
+	serveFlags := serveCmd.Flags()
+	serveFlags.StringVarP(&flagAddr, "addr", "a", "localhost:3000", "The address to listen on")
+	serveFlags.BoolVarP(&flagDev, "dev", "d", false, "Recompile assets on request and live reload them instead of serving precompiled ones")
+
+	rootCmd.AddCommand(&buildCmd)
+	rootCmd.AddCommand(&serveCmd)
+	rootCmd.AddCommand(&watchCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		if err != nil {
@@ -77,7 +103,7 @@ func setup(cmd *cobra.Command, args []string) {
 
 	log.Info("reading config", zap.String("file", flagConfig))
 
-	if _, err := toml.DecodeFile(flagConfig, &pipeline); err != nil {
+	if err := pipeline.LoadConfig(flagConfig); err != nil {
 		log.Fatal("failed to read config", zap.Error(err))
 	}
 
@@ -100,10 +126,17 @@ func setup(cmd *cobra.Command, args []string) {
 			setConfigString(val.Field(i).Addr().Interface().(*string), tag)
 		case reflect.Bool:
 			setConfigBool(val.Field(i).Addr().Interface().(*bool), tag)
+		case reflect.Int:
+			setConfigInt(val.Field(i).Addr().Interface().(*int), tag)
 		default:
 			continue
 		}
 	}
+
+	// Flags and environment variables may have overridden the file
+	if err := pipeline.Validate(); err != nil {
+		log.Fatal("invalid config", zap.Error(err))
+	}
 }
 
 func rootCmdCobra(cmd *cobra.Command, args []string) {
@@ -111,8 +144,7 @@ func rootCmdCobra(cmd *cobra.Command, args []string) {
 }
 
 func setConfigString(inStruct *string, name string) {
-	flag := pflag.Lookup(name)
-	if flag != nil && flag.Changed {
+	if flag := lookupFlag(name); flag != nil && flag.Changed {
 		*inStruct = flag.Value.String()
 	} else if env := tagEnv(name); len(env) != 0 {
 		*inStruct = env
@@ -121,7 +153,7 @@ func setConfigString(inStruct *string, name string) {
 
 func setConfigBool(inStruct *bool, name string) {
 	var strval string
-	if flag := pflag.Lookup(name); flag != nil && flag.Changed {
+	if flag := lookupFlag(name); flag != nil && flag.Changed {
 		strval = flag.Value.String()
 	} else if env := tagEnv(name); len(env) != 0 {
 		strval = env
@@ -135,6 +167,45 @@ func setConfigBool(inStruct *bool, name string) {
 	}
 }
 
+func setConfigInt(inStruct *int, name string) {
+	var strval string
+	if flag := lookupFlag(name); flag != nil && flag.Changed {
+		strval = flag.Value.String()
+	} else if env := tagEnv(name); len(env) != 0 {
+		strval = env
+	} else {
+		return
+	}
+
+	var err error
+	if *inStruct, err = strconv.Atoi(strval); err != nil {
+		log.Fatal("failed to parse int", zap.String("config-key", name))
+	}
+}
+
+// lookupFlag finds the flag for a config key, config keys use underscores
+// where flags use dashes.
+func lookupFlag(name string) *pflag.Flag {
+	return flags.Lookup(strings.Replace(name, "_", "-", -1))
+}
+
 func tagEnv(name string) string {
 	return os.Getenv(envPrefix + strings.ToUpper(name))
 }
+
+// interruptContext returns a context that is cancelled on SIGINT so that
+// commands started by the pipeline are killed with pipedream. They run in
+// their own process group and don't receive the signal themselves. A second
+// SIGINT exits straight away in case shutting down hangs.
+func interruptContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		<-signals
+		cancel()
+		signal.Stop(signals)
+	}()
+
+	return ctx
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	stdlog "log"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/uber-go/zap"
+)
+
+var serveCmd = cobra.Command{
+	Use:   "serve",
+	Short: "Serve assets over http, recompiling and live reloading them in dev mode",
+	Run:   serveCmdCobra,
+}
+
+var (
+	flagAddr string
+	flagDev  bool
+)
+
+func serveCmdCobra(cmd *cobra.Command, args []string) {
+	handlerLog := stdlog.New(os.Stderr, "", stdlog.LstdFlags)
+	ctx := interruptContext()
+
+	mux := http.NewServeMux()
+
+	if flagDev {
+		// Assets are compiled by the dynamic handler as they're requested,
+		// the watcher only tells browsers to reload them
+		watcher := pipeline.Watcher(handlerLog)
+		watcher.NotifyOnly = true
+		go func() {
+			if err := watcher.Watch(ctx); err != nil {
+				log.Fatal("watch failed", zap.Error(err))
+			}
+		}()
+
+		mux.Handle("/assets/__pipedream/", watcher.ReloadHandler())
+		mux.Handle("/assets/", pipeline.DynamicHandler(handlerLog))
+	} else {
+		if err := pipeline.LoadManifest(); err != nil {
+			log.Fatal("failed to load manifest, did you run build?", zap.Error(err))
+		}
+		mux.Handle("/assets/", pipeline.StaticHandler(handlerLog))
+	}
+
+	// Requests are cancelled on interrupt so compiles in progress are killed
+	// before the server finishes shutting down
+	server := &http.Server{
+		Addr:        flagAddr,
+		Handler:     mux,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		if err := server.Shutdown(context.Background()); err != nil {
+			log.Error("failed to shut down server", zap.Error(err))
+		}
+		close(stopped)
+	}()
+
+	log.Info("serving assets", zap.String("addr", flagAddr), zap.Bool("dev", flagDev))
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal("server stopped", zap.Error(err))
+	}
+	<-stopped
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	stdlog "log"
+	"os"
+
+	"github.com/nullbio/pipedream"
+	"github.com/spf13/cobra"
+	"github.com/uber-go/zap"
+)
+
+var watchCmd = cobra.Command{
+	Use:   "watch",
+	Short: "Compile assets and recompile them as they change",
+	Run:   watchCmdCobra,
+}
+
+func watchCmdCobra(cmd *cobra.Command, args []string) {
+	watcher := pipeline.Watcher(stdlog.New(os.Stderr, "", stdlog.LstdFlags))
+	events, unsubscribe := watcher.Subscribe()
+	defer unsubscribe()
+
+	go logEvents(events)
+
+	log.Info("watching assets", zap.String("in", pipeline.In), zap.String("out", pipeline.Out))
+	if err := watcher.Watch(interruptContext()); err != nil {
+		log.Fatal("watch failed", zap.Error(err))
+	}
+}
+
+func logEvents(events <-chan pipedream.Event) {
+	for e := range events {
+		if e.Removed {
+			log.Info("removed", zap.String("file", e.Source))
+			continue
+		}
+
+		for _, r := range e.Results {
+			if r.Err != nil {
+				log.Error("failed to compile", zap.String("file", r.Source), zap.Error(r.Err))
+				continue
+			}
+
+			log.Info("compiled", zap.String("asset", r.Asset), zap.String("output", r.Output))
+		}
+	}
+}
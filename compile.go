@@ -0,0 +1,472 @@
+package pipedream
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// CompileResult is the outcome of compiling a single asset
+type CompileResult struct {
+	Type   string // js
+	Source string // /home/assets/js/homepage/app.js.ts
+	Asset  string // js/homepage/app.js
+	Output string // /assets/js/homepage/app-209320932030293.js
+	Cached bool   // true if the output from a previous compile was reused
+	Err    error
+
+	info FileInfo
+}
+
+// Compile walks every asset type folder in p.In and runs each file through
+// its pipeline. If every file succeeds the manifest is written to
+// p.Out/assets/manifest.json and loaded into the Pipedream.
+//
+// Sources whose contents and pipeline configuration are unchanged since the
+// manifest on disk was written are not recompiled, their previous outputs
+// are reused instead. Previous outputs that are no longer used are removed.
+//
+// A result is returned for every file found whether it succeeded or not, the
+// error is non-nil if any file failed or the manifest could not be written.
+func (p *Pipedream) Compile() ([]CompileResult, error) {
+	return p.CompileContext(context.Background())
+}
+
+// CompileContext is Compile but any commands still running when ctx is done
+// are killed and the files that haven't been compiled yet fail.
+func (p *Pipedream) CompileContext(ctx context.Context) ([]CompileResult, error) {
+	previous, err := p.previousManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, results, err := p.compile(ctx, previous)
+	if err != nil {
+		return results, err
+	}
+
+	if err := p.writeManifest(manifest); err != nil {
+		return results, err
+	}
+
+	p.setManifest(manifest)
+	p.removeStaleOutputs(previous, manifest)
+	return results, nil
+}
+
+// previousManifest reads the manifest on disk, it's empty if there isn't one
+func (p *Pipedream) previousManifest() (Manifest, error) {
+	previous, err := p.readManifest()
+	if os.IsNotExist(errors.Cause(err)) {
+		return Manifest{}, nil
+	} else if err != nil {
+		return Manifest{}, err
+	}
+
+	return previous, nil
+}
+
+// compile compiles every asset, reusing the outputs recorded in previous
+// where it can, and returns the resulting manifest. If some files fail the
+// manifest still holds every result that succeeded, and the previous entries
+// for the sources that failed, along with the error. If the assets couldn't
+// be listed the manifest is empty.
+func (p *Pipedream) compile(ctx context.Context, previous Manifest) (Manifest, []CompileResult, error) {
+	manifest := newManifest()
+
+	var jobs []compileJob
+	for _, typ := range p.assetTypes() {
+		files, err := p.assetFiles(typ)
+		if err != nil {
+			return Manifest{}, nil, err
+		}
+
+		for _, file := range files {
+			jobs = append(jobs, compileJob{typ: typ, file: file})
+		}
+	}
+
+	p.runJobs(ctx, previous, jobs)
+
+	var results []CompileResult
+	failed := 0
+
+	for _, job := range jobs {
+		manifest.checkDuplicates(job.key, job.results)
+		results = append(results, job.results...)
+		if n := manifest.addSource(job.key, job.source, job.results); n != 0 {
+			failed += n
+			manifest.keepSource(previous, job.key)
+		}
+	}
+
+	if failed != 0 {
+		return manifest, results, errors.Errorf("failed to compile %d of %d assets", failed, len(results))
+	}
+
+	return manifest, results, nil
+}
+
+func newManifest() Manifest {
+	return Manifest{
+		Files:   make(map[string]FileInfo),
+		Assets:  make(map[string]string),
+		Sources: make(map[string]SourceInfo),
+	}
+}
+
+// clone returns a deep copy of the manifest
+func (m Manifest) clone() Manifest {
+	c := newManifest()
+	for k, v := range m.Files {
+		c.Files[k] = v
+	}
+	for k, v := range m.Assets {
+		c.Assets[k] = v
+	}
+	for k, v := range m.Sources {
+		v.Assets = append([]string(nil), v.Assets...)
+		c.Sources[k] = v
+	}
+
+	return c
+}
+
+// addSource records the successful results of compiling a source in the
+// manifest and returns the number of results that failed.
+func (m Manifest) addSource(key string, source SourceInfo, results []CompileResult) int {
+	failed := 0
+	source.Assets = nil
+
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+			continue
+		}
+
+		m.Assets[r.Asset] = r.Output
+		m.Files[r.Output] = r.info
+		source.Assets = append(source.Assets, r.Asset)
+	}
+
+	if len(source.Assets) != 0 {
+		m.Sources[key] = source
+	}
+
+	return failed
+}
+
+// checkDuplicates fails the results of a source for assets that another
+// source in m already provides, eg. js/app.js and js/app.js.ts
+func (m Manifest) checkDuplicates(key string, results []CompileResult) {
+	for i, r := range results {
+		if r.Err != nil {
+			continue
+		}
+		if _, ok := m.Assets[r.Asset]; !ok {
+			continue
+		}
+
+		if owner, ok := m.assetSource(r.Asset); ok && owner != key {
+			results[i].Err = errors.Errorf("asset %s from %s is already provided by %s", r.Asset, r.Source, owner)
+		}
+	}
+}
+
+// assetSource returns the key of the source that provides asset
+func (m Manifest) assetSource(asset string) (string, bool) {
+	for key, source := range m.Sources {
+		for _, a := range source.Assets {
+			if a == asset {
+				return key, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// removeStaleOutputs deletes the output files, and their compressed copies,
+// that previous recorded and current no longer does. It must only be called
+// once current has been written.
+func (p *Pipedream) removeStaleOutputs(previous, current Manifest) {
+	for output, info := range previous.Files {
+		if _, ok := current.Files[output]; ok {
+			continue
+		}
+
+		file := filepath.Join(p.Out, filepath.FromSlash(output))
+		files := []string{file}
+		for _, enc := range lookupEncodings(info.Encodings) {
+			files = append(files, file+enc.Extension)
+		}
+
+		for _, f := range files {
+			if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+				p.logf("failed to remove stale output %s: %v", f, err)
+			}
+		}
+	}
+}
+
+// keepSource copies a source and the assets compiled from it from previous,
+// replacing anything recorded for it in m
+func (m Manifest) keepSource(previous Manifest, key string) {
+	source, ok := previous.Sources[key]
+	if !ok {
+		return
+	}
+
+	m.removeSource(key)
+	for _, asset := range source.Assets {
+		output, ok := previous.Assets[asset]
+		if !ok {
+			continue
+		}
+
+		m.Assets[asset] = output
+		m.Files[output] = previous.Files[output]
+	}
+	source.Assets = append([]string(nil), source.Assets...)
+	m.Sources[key] = source
+}
+
+// removeSource forgets a source and the assets compiled from it
+func (m Manifest) removeSource(key string) {
+	source, ok := m.Sources[key]
+	if !ok {
+		return
+	}
+
+	for _, asset := range source.Assets {
+		delete(m.Files, m.Assets[asset])
+		delete(m.Assets, asset)
+	}
+	delete(m.Sources, key)
+}
+
+// compileJob is a single source file to compile and the outcome of
+// compiling it
+type compileJob struct {
+	typ  string
+	file string
+
+	key     string
+	source  SourceInfo
+	results []CompileResult
+}
+
+// runJobs compiles every job using up to p.Jobs workers. Each job's outcome
+// is stored in place so the order of jobs is preserved.
+func (p *Pipedream) runJobs(ctx context.Context, previous Manifest, jobs []compileJob) {
+	indexes := make(chan int)
+	wg := sync.WaitGroup{}
+
+	workers := p.concurrency()
+	if workers > len(jobs) {
+		workers = len(jobs)
+	}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				job := &jobs[i]
+				job.key, job.source, job.results = p.compileFile(ctx, previous, job.typ, job.file)
+			}
+		}()
+	}
+
+	for i := range jobs {
+		indexes <- i
+	}
+	close(indexes)
+
+	wg.Wait()
+}
+
+// concurrency returns how many files may be compiled at once
+func (p *Pipedream) concurrency() int {
+	if p.Jobs > 0 {
+		return p.Jobs
+	}
+
+	return runtime.NumCPU()
+}
+
+// compileFile compiles a single source file, reusing the outputs recorded in
+// previous if neither the source nor its pipeline have changed. It returns
+// the key and details of the source for the manifest, the assets produced
+// are filled in by the caller.
+func (p *Pipedream) compileFile(ctx context.Context, previous Manifest, typ, file string) (string, SourceInfo, []CompileResult) {
+	var source SourceInfo
+
+	fail := func(err error) []CompileResult {
+		return []CompileResult{{
+			Type:   typ,
+			Source: file,
+			Err:    errors.Wrapf(err, "failed to transform %s", file),
+		}}
+	}
+
+	key, err := filepath.Rel(p.In, file)
+	if err != nil {
+		return key, source, fail(errors.Wrap(err, "failed to find relative path"))
+	}
+	key = filepath.ToSlash(key)
+
+	fn, err := p.mkFileNaming(typ, file)
+	if err != nil {
+		return key, source, fail(err)
+	}
+
+	if source.Digest, err = fileDigest(file); err != nil {
+		return key, source, fail(err)
+	}
+	if source.Pipeline, err = p.pipelineDigest(typ, fn.Extension, fn.Extensions); err != nil {
+		return key, source, fail(err)
+	}
+
+	if cached, ok := p.cachedResults(previous, key, source, typ, file); ok {
+		return key, source, cached
+	}
+
+	if err = ctx.Err(); err != nil {
+		return key, source, fail(err)
+	}
+
+	outs, err := p.transform(ctx, typ, file)
+	if err != nil {
+		return key, source, fail(err)
+	}
+
+	results := make([]CompileResult, 0, len(outs))
+	for _, out := range outs {
+		result := CompileResult{Type: typ, Source: file, Asset: out.Asset}
+		result.Output, result.Err = p.urlPath(out.Path)
+		result.info = FileInfo{
+			Digest:      out.Digest,
+			Integrity:   out.Integrity,
+			MTime:       out.MTime,
+			Size:        out.Size,
+			ContentType: out.ContentType,
+			Encodings:   out.Encodings,
+		}
+		results = append(results, result)
+	}
+
+	return key, source, results
+}
+
+// cachedResults returns the results of a previous compile of a source if
+// its digest and pipeline are unchanged and all of its outputs, including
+// their compressed copies, still exist.
+func (p *Pipedream) cachedResults(previous Manifest, key string, source SourceInfo, typ, file string) ([]CompileResult, bool) {
+	prev, ok := previous.Sources[key]
+	if !ok || prev.Digest != source.Digest || prev.Pipeline != source.Pipeline || len(prev.Assets) == 0 {
+		return nil, false
+	}
+
+	results := make([]CompileResult, 0, len(prev.Assets))
+	for _, asset := range prev.Assets {
+		output, ok := previous.Assets[asset]
+		if !ok {
+			return nil, false
+		}
+		info, ok := previous.Files[output]
+		if !ok {
+			return nil, false
+		}
+		outFile := filepath.Join(p.Out, filepath.FromSlash(output))
+		if _, err := os.Stat(outFile); err != nil {
+			return nil, false
+		}
+		for _, enc := range lookupEncodings(info.Encodings) {
+			if _, err := os.Stat(outFile + enc.Extension); err != nil {
+				return nil, false
+			}
+		}
+
+		results = append(results, CompileResult{
+			Type:   typ,
+			Source: file,
+			Asset:  asset,
+			Output: output,
+			Cached: true,
+			info:   info,
+		})
+	}
+
+	return results, true
+}
+
+// assetFiles returns every file in the input folder for typ. Hidden files
+// and folders are skipped.
+func (p *Pipedream) assetFiles(typ string) ([]string, error) {
+	root := filepath.Join(p.In, typ)
+
+	var files []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == root && os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+
+		if path != root && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if info.Mode().IsRegular() {
+			files = append(files, path)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to walk %s", root)
+	}
+
+	return files, nil
+}
+
+// urlPath turns a full path in the output folder into the url it will be
+// served from: /home/compiled/assets/js/app-abc.js -> /assets/js/app-abc.js
+func (p *Pipedream) urlPath(file string) (string, error) {
+	rel, err := filepath.Rel(p.Out, file)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to find relative output path")
+	}
+
+	return "/" + filepath.ToSlash(rel), nil
+}
+
+// fileDigest returns the hex md5 of a file's contents
+func fileDigest(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to open file for digest")
+	}
+	defer f.Close()
+
+	hash := md5.New()
+	if _, err = io.Copy(hash, f); err != nil {
+		return "", errors.Wrap(err, "failed to read file for digest")
+	}
+
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
@@ -0,0 +1,538 @@
+package pipedream
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestCompile(t *testing.T) {
+	t.Parallel()
+
+	in := filepath.Join(testTmp, "compile")
+	out := filepath.Join(testTmp, "compile_out")
+
+	files := map[string]string{
+		"js/homepage/app.js.cat": testTransformFile,
+		"js/.hidden.js":          testTransformFile,
+		"css/main.css":           testTransformFile,
+		"img/.git/image.png":     testTransformFile,
+		"img/image.png":          testTransformFile,
+	}
+	for name, contents := range files {
+		file := filepath.Join(in, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0775); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(contents), 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var p Pipedream
+	p.In = in
+	p.Out = out
+	p.NoCompress = true
+	p.JS.Compilers = map[string]Command{
+		"cat": Command{
+			Cmd:    "cat",
+			Stdin:  true,
+			Stdout: true,
+		},
+	}
+
+	results, err := p.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 3 {
+		t.Errorf("wanted 3 results, got: %d", len(results))
+	}
+
+	outputs := map[string]*regexp.Regexp{
+		"js/homepage/app.js": regexp.MustCompile(`^/assets/js/homepage/app-[0-9a-f]{32}\.js$`),
+		"css/main.css":       regexp.MustCompile(`^/assets/css/main-[0-9a-f]{32}\.css$`),
+		"img/image.png":      regexp.MustCompile(`^/assets/img/image-[0-9a-f]{32}\.png$`),
+	}
+
+	var loaded Pipedream
+	loaded.Out = out
+	if err := loaded.LoadManifest(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(loaded.Manifest.Assets) != len(outputs) {
+		t.Errorf("wanted %d assets, got: %v", len(outputs), loaded.Manifest.Assets)
+	}
+
+	for asset, rgx := range outputs {
+		url, ok := loaded.Manifest.Assets[asset]
+		if !ok {
+			t.Errorf("asset %s missing from manifest", asset)
+			continue
+		}
+		if !rgx.MatchString(url) {
+			t.Errorf("asset %s url was wrong: %s", asset, url)
+		}
+		if url != p.Manifest.Assets[asset] {
+			t.Errorf("asset %s was not loaded into the pipedream: %s", asset, p.Manifest.Assets[asset])
+		}
+
+		info, ok := loaded.Manifest.Files[url]
+		if !ok {
+			t.Errorf("file %s missing from manifest", url)
+			continue
+		}
+		if info.Size != uint64(len(testTransformFile)) {
+			t.Errorf("file %s size was wrong: %d", url, info.Size)
+		}
+		if len(info.Digest) != 32 {
+			t.Errorf("file %s digest was wrong: %s", url, info.Digest)
+		}
+		if want := mime.TypeByExtension(path.Ext(asset)); info.ContentType != want {
+			t.Errorf("file %s content type was wrong: %s", url, info.ContentType)
+		}
+
+		b, err := ioutil.ReadFile(filepath.Join(out, filepath.FromSlash(url)))
+		if err != nil {
+			t.Error(err)
+		} else if string(b) != testTransformFile {
+			t.Errorf("file %s was wrong:\n%s", url, b)
+		}
+	}
+}
+
+func TestCompileCustomTypes(t *testing.T) {
+	t.Parallel()
+
+	in := filepath.Join(testTmp, "compile_types")
+	out := filepath.Join(testTmp, "compile_types_out")
+
+	files := map[string]string{
+		"wasm/app.wasm.cat":  testTransformFile,
+		"maps/world.json":    testTransformFile,
+		"unknown/thing.json": testTransformFile,
+	}
+	for name, contents := range files {
+		file := filepath.Join(in, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0775); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(contents), 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var p Pipedream
+	p.In = in
+	p.Out = out
+	p.NoCompress = true
+	p.Types = map[string]Exes{
+		"wasm": {Compilers: map[string]Command{
+			"cat": {Cmd: "cat", Stdin: true, Stdout: true},
+		}},
+		"maps": {},
+	}
+
+	results, err := p.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 2 {
+		t.Errorf("wanted 2 results, got: %d", len(results))
+	}
+
+	if got := p.Path("wasm", "app.wasm"); !regexp.MustCompile(`^/assets/wasm/app-[0-9a-f]{32}\.wasm$`).MatchString(got) {
+		t.Error("path was wrong:", got)
+	}
+	if got := p.Path("maps", "world.json"); !regexp.MustCompile(`^/assets/maps/world-[0-9a-f]{32}\.json$`).MatchString(got) {
+		t.Error("path was wrong:", got)
+	}
+	if _, err := p.AssetPath("unknown", "thing.json"); err == nil {
+		t.Error("unconfigured types should not be compiled")
+	}
+
+	if ct := p.Manifest.Files[p.Path("wasm", "app.wasm")].ContentType; ct != "application/wasm" {
+		t.Error("content type was wrong:", ct)
+	}
+}
+
+func TestCompileContextCancelled(t *testing.T) {
+	t.Parallel()
+
+	in := filepath.Join(testTmp, "compile_cancelled")
+	file := filepath.Join(in, "js", "app.js")
+	if err := os.MkdirAll(filepath.Dir(file), 0775); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, []byte(testTransformFile), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	var p Pipedream
+	p.In = in
+	p.Out = filepath.Join(testTmp, "compile_cancelled_out")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	results, err := p.CompileContext(ctx)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(results) != 1 || errors.Cause(results[0].Err) != context.Canceled {
+		t.Errorf("expected a cancelled result, got: %#v", results)
+	}
+	if _, err := os.Stat(filepath.Join(p.Out, "assets", "manifest.json")); err == nil {
+		t.Error("manifest should not have been written")
+	}
+}
+
+func TestCompileFailure(t *testing.T) {
+	t.Parallel()
+
+	in := filepath.Join(testTmp, "compile_fail")
+	out := filepath.Join(testTmp, "compile_fail_out")
+
+	if err := os.MkdirAll(filepath.Join(in, "js"), 0775); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(in, "js", "good.js"), []byte(testTransformFile), 0664); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(in, "js", "bad.js.fail"), []byte(testTransformFile), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	var p Pipedream
+	p.In = in
+	p.Out = out
+	p.NoCompress = true
+	p.JS.Compilers = map[string]Command{
+		"fail": Command{
+			Cmd: "false",
+		},
+	}
+
+	results, err := p.Compile()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if len(results) != 2 {
+		t.Fatalf("wanted 2 results, got: %d", len(results))
+	}
+
+	for _, r := range results {
+		switch filepath.Base(r.Source) {
+		case "bad.js.fail":
+			if r.Err == nil {
+				t.Error("bad.js.fail should have failed")
+			}
+		case "good.js":
+			if r.Err != nil {
+				t.Error("good.js should not have failed:", r.Err)
+			}
+		default:
+			t.Error("unexpected result:", r.Source)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(out, "assets", "manifest.json")); !os.IsNotExist(err) {
+		t.Error("manifest should not have been written:", err)
+	}
+}
+
+func TestCompileDuplicateAsset(t *testing.T) {
+	t.Parallel()
+
+	in := filepath.Join(testTmp, "compile_duplicate")
+	if err := os.MkdirAll(filepath.Join(in, "js"), 0775); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"app.js", "app.js.cat"} {
+		if err := ioutil.WriteFile(filepath.Join(in, "js", name), []byte(testTransformFile), 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var p Pipedream
+	p.In = in
+	p.Out = filepath.Join(testTmp, "compile_duplicate_out")
+	p.NoCompress = true
+	p.JS.Compilers = map[string]Command{
+		"cat": Command{
+			Cmd:    "cat",
+			Stdin:  true,
+			Stdout: true,
+		},
+	}
+
+	results, err := p.Compile()
+	if err == nil {
+		t.Error("expected an error for a duplicate asset")
+	}
+	if len(results) != 2 {
+		t.Fatalf("wanted 2 results, got: %d", len(results))
+	}
+
+	if results[0].Err != nil {
+		t.Error("first source should compile:", results[0].Err)
+	}
+	if results[1].Err == nil || !strings.Contains(results[1].Err.Error(), "already provided by js/app.js") {
+		t.Error("second source should fail as a duplicate, got:", results[1].Err)
+	}
+}
+
+func TestCompileIncremental(t *testing.T) {
+	t.Parallel()
+
+	in := filepath.Join(testTmp, "compile_incremental")
+	out := filepath.Join(testTmp, "compile_incremental_out")
+	counter := filepath.Join(testTmp, "compile_incremental_count")
+	inFile := filepath.Join(in, "js", "app.js.count")
+
+	if err := os.MkdirAll(filepath.Dir(inFile), 0775); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(inFile, []byte(testTransformFile), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	var p Pipedream
+	p.In = in
+	p.Out = out
+	p.NoCompress = true
+	p.JS.Compilers = map[string]Command{
+		"count": Command{
+			Cmd:    "sh",
+			Args:   []string{"-c", `echo >> "$0"; cat`, counter},
+			Stdin:  true,
+			Stdout: true,
+		},
+	}
+
+	runs := func() int {
+		b, err := ioutil.ReadFile(counter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(b)
+	}
+
+	compile := func(wantCached bool) {
+		results, err := p.Compile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 1 {
+			t.Fatalf("wanted 1 result, got: %d", len(results))
+		}
+		if results[0].Cached != wantCached {
+			t.Errorf("wanted cached to be %t", wantCached)
+		}
+		if _, ok := p.Manifest.Assets["js/app.js"]; !ok {
+			t.Error("asset missing from manifest")
+		}
+	}
+
+	compile(false)
+	compile(true)
+	if n := runs(); n != 1 {
+		t.Errorf("compiler should have run once, ran: %d", n)
+	}
+
+	if err := ioutil.WriteFile(inFile, []byte(testTransformFileGZ), 0664); err != nil {
+		t.Fatal(err)
+	}
+	compile(false)
+	if n := runs(); n != 2 {
+		t.Errorf("changed source should recompile, ran: %d", n)
+	}
+
+	p.JS.Minifier = Command{
+		Cmd:    "cat",
+		Args:   []string{"$infile"},
+		Stdout: true,
+	}
+	compile(false)
+	if n := runs(); n != 3 {
+		t.Errorf("changed pipeline should recompile, ran: %d", n)
+	}
+
+	if err := os.Remove(filepath.Join(out, filepath.FromSlash(p.Manifest.Assets["js/app.js"]))); err != nil {
+		t.Fatal(err)
+	}
+	compile(false)
+	if n := runs(); n != 4 {
+		t.Errorf("missing output should recompile, ran: %d", n)
+	}
+}
+
+func TestCompileIncrementalEncodings(t *testing.T) {
+	t.Parallel()
+
+	in := filepath.Join(testTmp, "compile_encodings")
+	out := filepath.Join(testTmp, "compile_encodings_out")
+	inFile := filepath.Join(in, "js", "app.js")
+
+	if err := os.MkdirAll(filepath.Dir(inFile), 0775); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(inFile, []byte(testTransformFile), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	var p Pipedream
+	p.In = in
+	p.Out = out
+	p.Brotli = true
+
+	if _, err := p.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	outFile := filepath.Join(out, filepath.FromSlash(p.Manifest.Assets["js/app.js"]))
+	if err := os.Remove(outFile + ".br"); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := p.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Cached {
+		t.Errorf("missing compressed copy should recompile: %#v", results)
+	}
+
+	if _, err := os.Stat(outFile + ".br"); err != nil {
+		t.Error("compressed copy was not recreated:", err)
+	}
+}
+
+func TestCompileRemovesStaleOutputs(t *testing.T) {
+	t.Parallel()
+
+	in := filepath.Join(testTmp, "compile_stale")
+	out := filepath.Join(testTmp, "compile_stale_out")
+	inFile := filepath.Join(in, "js", "app.js")
+	otherFile := filepath.Join(in, "js", "other.js")
+
+	if err := os.MkdirAll(filepath.Dir(inFile), 0775); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{inFile, otherFile} {
+		if err := ioutil.WriteFile(file, []byte(testTransformFile), 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var p Pipedream
+	p.In = in
+	p.Out = out
+
+	if _, err := p.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	var stale []string
+	for _, asset := range []string{"js/app.js", "js/other.js"} {
+		output := p.Manifest.Assets[asset]
+		file := filepath.Join(out, filepath.FromSlash(output))
+		stale = append(stale, file)
+		for _, enc := range lookupEncodings(p.Manifest.Files[output].Encodings) {
+			stale = append(stale, file+enc.Extension)
+		}
+	}
+	if len(stale) < 4 {
+		t.Fatalf("expected compressed copies of the outputs: %v", stale)
+	}
+
+	if err := ioutil.WriteFile(inFile, []byte(testTransformFileGZ), 0664); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(otherFile); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range stale {
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Errorf("stale output was not removed: %s", file)
+		}
+	}
+
+	current := filepath.Join(out, filepath.FromSlash(p.Manifest.Assets["js/app.js"]))
+	if _, err := os.Stat(current); err != nil {
+		t.Error("current output is missing:", err)
+	}
+}
+
+func TestCompileConcurrent(t *testing.T) {
+	t.Parallel()
+
+	in := filepath.Join(testTmp, "compile_concurrent")
+	out := filepath.Join(testTmp, "compile_concurrent_out")
+
+	if err := os.MkdirAll(filepath.Join(in, "js"), 0775); err != nil {
+		t.Fatal(err)
+	}
+
+	var sources []string
+	for i := 0; i < 20; i++ {
+		file := filepath.Join(in, "js", fmt.Sprintf("file%02d.js.cat", i))
+		if err := ioutil.WriteFile(file, []byte(fmt.Sprintf("file %d", i)), 0664); err != nil {
+			t.Fatal(err)
+		}
+		sources = append(sources, file)
+	}
+
+	var p Pipedream
+	p.In = in
+	p.Out = out
+	p.Jobs = 4
+	p.NoCompress = true
+	p.JS.Compilers = map[string]Command{
+		"cat": Command{
+			Cmd:    "cat",
+			Stdin:  true,
+			Stdout: true,
+		},
+	}
+
+	results, err := p.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != len(sources) {
+		t.Fatalf("wanted %d results, got: %d", len(sources), len(results))
+	}
+
+	for i, r := range results {
+		if r.Source != sources[i] {
+			t.Errorf("result %d out of order: %s", i, r.Source)
+		}
+
+		b, err := ioutil.ReadFile(filepath.Join(out, filepath.FromSlash(p.Manifest.Assets[r.Asset])))
+		if err != nil {
+			t.Error(err)
+		} else if want := fmt.Sprintf("file %d", i); string(b) != want {
+			t.Errorf("file %d was wrong: %s", i, b)
+		}
+	}
+}
@@ -3,11 +3,16 @@ package pipedream
 import (
 	"encoding/json"
 	"io/ioutil"
+	"log"
+	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
 )
 
 const (
@@ -19,6 +24,10 @@ const (
 	typeFonts  = "fonts"
 )
 
+// builtinTypes are the asset types that are always compiled, they're
+// configured by Executables rather than Types.
+var builtinTypes = []string{typeJS, typeCSS, typeImg, typeAudio, typeVideos, typeFonts}
+
 // Pipedream is the config for pipedream
 type Pipedream struct {
 	In  string `toml:"in"`
@@ -31,8 +40,54 @@ type Pipedream struct {
 	NoHash     bool `toml:"no_hash"`
 	NoCompress bool `toml:"no_compress"`
 
+	// Brotli writes a .br copy of each file alongside the .gz
+	Brotli bool `toml:"brotli"`
+	// Zstd writes a .zst copy of each file alongside the .gz
+	Zstd bool `toml:"zstd"`
+
+	// CompressMinSize is the size in bytes a file must be before it's
+	// compressed, it can be overridden for each type.
+	CompressMinSize int `toml:"compress_min_size"`
+	// Compressible are the MIME types of files that are compressed, either
+	// exact or a wildcard subtype like text/*. DefaultCompressible is used
+	// if it's empty.
+	Compressible []string `toml:"compressible"`
+
+	// FingerprintHash is the algorithm used to fingerprint file names: md5,
+	// sha1, sha256, sha384 or sha512. Defaults to DefaultFingerprintHash.
+	FingerprintHash string `toml:"fingerprint_hash"`
+	// IntegrityHash is the algorithm used for Subresource Integrity:
+	// sha256, sha384 or sha512. Defaults to DefaultIntegrityHash.
+	IntegrityHash string `toml:"integrity_hash"`
+
+	// UnhashedCacheControl is the Cache-Control header served for files
+	// when NoHash is set, defaults to DefaultUnhashedCacheControl.
+	UnhashedCacheControl string `toml:"unhashed_cache_control"`
+
+	// Jobs is how many files are compiled concurrently, defaults to the
+	// number of CPUs.
+	Jobs int `toml:"jobs"`
+
+	// MissingAsset is what the template helpers do when an asset is not in
+	// the manifest: MissingAssetPanic, MissingAssetFallback or
+	// MissingAssetError. Defaults to MissingAssetPanic.
+	MissingAsset string `toml:"missing_asset"`
+	// Log receives warnings about missing assets, the standard logger is
+	// used if it's nil.
+	Log *log.Logger `toml:"-"`
+
 	Executables
+	// Types are user defined asset types in addition to the built in ones,
+	// keyed by the name of their folder in In, eg. [types.wasm]
+	Types map[string]Exes `toml:"types"`
+
+	// Manifest is the manifest loaded by LoadManifest or Compile. While a
+	// Watcher is running it's no longer updated, use CurrentManifest.
 	Manifest Manifest `toml:"-"`
+
+	// store holds the manifest once a Watcher has been created so it can be
+	// replaced while handlers and templates are reading it
+	store *manifestStore
 }
 
 // Executables are the compilers and minifiers used by the various file types
@@ -49,6 +104,12 @@ type Executables struct {
 type Exes struct {
 	Compilers map[string]Command `toml:"compilers"`
 	Minifier  Command            `toml:"minifier"`
+	// Minifiers are keyed by the extension of the compiled file and
+	// override Minifier for it, eg. svgo for svg and optipng for png files
+	Minifiers map[string]Command `toml:"minifiers"`
+
+	// CompressMinSize overrides Pipedream.CompressMinSize when it's not 0
+	CompressMinSize int `toml:"compress_min_size"`
 }
 
 // Command is an executable that can be run to consume input and produce output
@@ -58,12 +119,107 @@ type Command struct {
 	Args   []string `toml:"args"`
 	Stdout bool     `toml:"stdout"`
 	Stdin  bool     `toml:"stdin"`
+
+	// Transformer is the name of a registered Transformer to run in process
+	// instead of Cmd, see RegisterTransformer.
+	Transformer string `toml:"transformer"`
+	// Builtin is the name of a minifier built in to pipedream to run
+	// instead of Cmd: css, js, svg, json or html.
+	Builtin string `toml:"builtin"`
+
+	// Timeout kills the command, or stops waiting for the transformer, if
+	// it runs for longer, eg. "30s". There is no timeout if it's zero.
+	Timeout Duration `toml:"timeout"`
+
+	// Env are environment variables set for the command
+	Env map[string]string `toml:"env"`
+	// InheritEnv passes pipedream's own environment to the command as well
+	// as Env, it's true if it's not set.
+	InheritEnv *bool `toml:"inherit_env"`
+	// Dir is the working directory of the command. It can refer to the
+	// input folder as $in, the output folder as $out and the input folder
+	// for the asset type as $typedir, other variables are read from the
+	// environment. Defaults to the input file's folder when $infile is
+	// used, otherwise $typedir.
+	Dir string `toml:"dir"`
+}
+
+// inheritEnv is true if the command gets pipedream's environment
+func (c Command) inheritEnv() bool {
+	return c.InheritEnv == nil || *c.InheritEnv
+}
+
+// environ returns the environment for the command, nil if it's simply
+// pipedream's own.
+func (c Command) environ() []string {
+	if len(c.Env) == 0 && c.inheritEnv() {
+		return nil
+	}
+
+	// An empty but non-nil environment so nothing is inherited
+	env := []string{}
+	if c.inheritEnv() {
+		env = os.Environ()
+	}
+
+	keys := make([]string, 0, len(c.Env))
+	for k := range c.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		env = append(env, k+"="+c.Env[k])
+	}
+
+	return env
+}
+
+// expandDir replaces the placeholders in c.Dir
+func (c Command) expandDir(dirs commandDirs) string {
+	return os.Expand(c.Dir, func(name string) string {
+		switch name {
+		case "in":
+			return dirs.In
+		case "out":
+			return dirs.Out
+		case "typedir":
+			return dirs.Type
+		default:
+			return os.Getenv(name)
+		}
+	})
+}
+
+// Duration is a time.Duration configured as a string like "1m30s"
+type Duration time.Duration
+
+// UnmarshalText parses a duration string
+func (d *Duration) UnmarshalText(text []byte) error {
+	dur, err := time.ParseDuration(string(text))
+	if err != nil {
+		return errors.Wrapf(err, "invalid duration %q", text)
+	}
+
+	*d = Duration(dur)
+	return nil
+}
+
+// MarshalText formats the duration as a string
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// isZero is true if c does not run anything
+func (c Command) isZero() bool {
+	return len(c.Cmd) == 0 && len(c.Transformer) == 0 && len(c.Builtin) == 0
 }
 
 // Manifest for compiled assets
 type Manifest struct {
-	Files  map[string]FileInfo `json:"files"`
-	Assets map[string]string   `json:"assets"`
+	Files   map[string]FileInfo   `json:"files"`
+	Assets  map[string]string     `json:"assets"`
+	Sources map[string]SourceInfo `json:"sources,omitempty"`
 }
 
 // FileInfo keeps various properties about a file
@@ -71,34 +227,217 @@ type FileInfo struct {
 	Digest string    `json:"digest"`
 	MTime  time.Time `json:"mtime"`
 	Size   uint64    `json:"size"`
+
+	// Integrity is the Subresource Integrity value for the file
+	Integrity string `json:"integrity,omitempty"`
+
+	// ContentType of the file regardless of any encoding it's served with
+	ContentType string `json:"content_type,omitempty"`
+
+	// Encodings are the compressed copies that were written next to the
+	// file, eg. gzip is file.gz
+	Encodings []string `json:"encodings,omitempty"`
+}
+
+// SourceInfo records what a source file's assets were compiled from
+type SourceInfo struct {
+	Digest   string   `json:"digest"`
+	Pipeline string   `json:"pipeline"`
+	Assets   []string `json:"assets"`
 }
 
 // New loads a configuration
 func New(file string) (Pipedream, error) {
 	var pipedream Pipedream
-	_, err := toml.DecodeFile(file, &pipedream)
+	err := pipedream.LoadConfig(file)
+	return pipedream, err
+}
 
-	pipedream.CDNURL = strings.TrimRight(pipedream.CDNURL, "/")
+// LoadConfig decodes a configuration file into p and validates the result
+func (p *Pipedream) LoadConfig(file string) error {
+	if _, err := toml.DecodeFile(file, p); err != nil {
+		return err
+	}
 
-	return pipedream, err
+	p.CDNURL = strings.TrimRight(p.CDNURL, "/")
+
+	return p.Validate()
+}
+
+// Validate checks settings that can't be caught when they're decoded
+func (p Pipedream) Validate() error {
+	for typ := range p.Types {
+		if err := validType(typ); err != nil {
+			return err
+		}
+	}
+
+	switch p.MissingAsset {
+	case "", MissingAssetPanic, MissingAssetFallback, MissingAssetError:
+	default:
+		return errors.Errorf("invalid missing_asset %q, must be %s, %s or %s",
+			p.MissingAsset, MissingAssetPanic, MissingAssetFallback, MissingAssetError)
+	}
+
+	if _, ok := hashes[p.fingerprintHash()]; !ok {
+		return errors.Errorf("invalid fingerprint_hash %q, must be md5, sha1, sha256, sha384 or sha512", p.FingerprintHash)
+	}
+	if !integrityHashes[p.integrityHash()] {
+		return errors.Errorf("invalid integrity_hash %q, must be sha256, sha384 or sha512", p.IntegrityHash)
+	}
+
+	return nil
+}
+
+// validType checks a user defined type can be used as a folder name and
+// does not clash with a built in type or the reload handler.
+func validType(typ string) error {
+	for _, builtin := range builtinTypes {
+		if typ == builtin {
+			return errors.Errorf("type %s is built in, configure it with [%s] instead of [types.%s]", typ, typ, typ)
+		}
+	}
+
+	if len(typ) == 0 || strings.ContainsAny(typ, `/\`) || strings.HasPrefix(typ, ".") || strings.HasPrefix(typ, "__") {
+		return errors.Errorf("invalid type name: %q", typ)
+	}
+
+	return nil
 }
 
 // LoadManifest loads the manifest in p.OutPath/assets/manifest.json
 func (p *Pipedream) LoadManifest() error {
-	b, err := ioutil.ReadFile(filepath.Join(p.Out, "assets", "manifest.json"))
+	m, err := p.readManifest()
 	if err != nil {
 		return err
 	}
 
-	if err = json.Unmarshal(b, &p.Manifest); err != nil {
-		return err
+	p.setManifest(m)
+	return nil
+}
+
+// manifestStore guards a manifest that's replaced while it's being read
+type manifestStore struct {
+	mut      sync.RWMutex
+	manifest Manifest
+}
+
+// CurrentManifest returns the most recently compiled or loaded manifest,
+// it's safe to call while a Watcher is recompiling.
+func (p Pipedream) CurrentManifest() Manifest {
+	if p.store == nil {
+		return p.Manifest
+	}
+
+	p.store.mut.RLock()
+	defer p.store.mut.RUnlock()
+	return p.store.manifest
+}
+
+// setManifest replaces the manifest. The manifest must not be modified
+// afterwards as it may be read concurrently.
+func (p *Pipedream) setManifest(m Manifest) {
+	if p.store == nil {
+		p.Manifest = m
+		return
+	}
+
+	p.store.mut.Lock()
+	p.store.manifest = m
+	p.store.mut.Unlock()
+}
+
+// readManifest reads the manifest in p.OutPath/assets/manifest.json
+func (p *Pipedream) readManifest() (Manifest, error) {
+	var m Manifest
+
+	b, err := ioutil.ReadFile(filepath.Join(p.Out, "assets", "manifest.json"))
+	if err != nil {
+		return m, err
+	}
+
+	if err = json.Unmarshal(b, &m); err != nil {
+		return m, err
+	}
+
+	return m, nil
+}
+
+// writeManifest atomically writes m to p.OutPath/assets/manifest.json
+func (p *Pipedream) writeManifest(m Manifest) error {
+	dir := filepath.Join(p.Out, "assets")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrap(err, "failed to create manifest directory")
+	}
+
+	b, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal manifest")
+	}
+
+	tmp, err := ioutil.TempFile(dir, "manifest")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temporary manifest")
+	}
+
+	_, err = tmp.Write(b)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return errors.Wrap(err, "failed to write temporary manifest")
+	}
+
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		_ = os.Remove(tmp.Name())
+		return errors.Wrap(err, "failed to chmod temporary manifest")
+	}
+
+	if err = os.Rename(tmp.Name(), filepath.Join(dir, "manifest.json")); err != nil {
+		_ = os.Remove(tmp.Name())
+		return errors.Wrap(err, "failed to rename manifest to final destination")
 	}
 
 	return nil
 }
 
+// minifier returns the minifier for a compiled file with extension ext
+func (e Exes) minifier(ext string) Command {
+	if minifier, ok := e.Minifiers[strings.ToLower(ext)]; ok {
+		return minifier
+	}
+
+	return e.Minifier
+}
+
+// assetTypes returns every type of asset in the order they're compiled, the
+// built in types followed by user defined types sorted by name.
+func (p *Pipedream) assetTypes() []string {
+	types := append([]string(nil), builtinTypes...)
+
+	custom := make([]string, 0, len(p.Types))
+	for typ := range p.Types {
+		if _, ok := p.builtinExes(typ); !ok {
+			custom = append(custom, typ)
+		}
+	}
+	sort.Strings(custom)
+
+	return append(types, custom...)
+}
+
 // exes returns the exe for typ
-func (p *Pipedream) exes(typ string) (exes Exes, ok bool) {
+func (p *Pipedream) exes(typ string) (Exes, bool) {
+	if exes, ok := p.builtinExes(typ); ok {
+		return exes, true
+	}
+
+	exes, ok := p.Types[typ]
+	return exes, ok
+}
+
+func (p *Pipedream) builtinExes(typ string) (exes Exes, ok bool) {
 	switch typ {
 	case typeJS:
 		return p.JS, true
@@ -1,7 +1,13 @@
 package pipedream
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
@@ -53,7 +59,7 @@ func TestLoadConfig(t *testing.T) {
 	}
 	for i, a := range []string{"--outFile", "$outfile", "$infile"} {
 		if a != ts.Args[i] {
-			t.Errorf("argument %d was wrong:", ts.Args[i])
+			t.Errorf("argument %d was wrong: %s", i, ts.Args[i])
 		}
 	}
 
@@ -62,7 +68,164 @@ func TestLoadConfig(t *testing.T) {
 	}
 	for i, a := range []string{"$infile"} {
 		if a != min.Args[i] {
-			t.Errorf("argument %d was wrong:", min.Args[i])
+			t.Errorf("argument %d was wrong: %s", i, min.Args[i])
+		}
+	}
+}
+
+var testTypesConfig = `
+[types.wasm.compilers.wat]
+cmd = "wat2wasm"
+args = ["$infile", "-o", "$outfile"]
+
+[types.maps]
+compress_min_size = 10
+
+[types.maps.minifier]
+cmd = "jq"
+timeout = "1m30s"
+dir = "$in"
+inherit_env = false
+env = { NODE_ENV = "production" }
+`
+
+func TestLoadConfigTypes(t *testing.T) {
+	t.Parallel()
+
+	file := filepath.Join(testTmp, "types.toml")
+	if err := ioutil.WriteFile(file, []byte(testTypesConfig), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := New(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exes, ok := cfg.exes("wasm")
+	if !ok {
+		t.Fatal("there should be a wasm type")
+	}
+	if exes.Compilers["wat"].Cmd != "wat2wasm" {
+		t.Error("command was wrong:", exes.Compilers["wat"].Cmd)
+	}
+	if exes, _ = cfg.exes("maps"); exes.CompressMinSize != 10 {
+		t.Error("compress min size was wrong:", exes.CompressMinSize)
+	}
+	if exes.Minifier.Timeout != Duration(90*time.Second) {
+		t.Error("timeout was wrong:", time.Duration(exes.Minifier.Timeout))
+	}
+	if exes.Minifier.Dir != "$in" {
+		t.Error("dir was wrong:", exes.Minifier.Dir)
+	}
+	if exes.Minifier.inheritEnv() {
+		t.Error("environment should not be inherited")
+	}
+	if env := exes.Minifier.environ(); !reflect.DeepEqual(env, []string{"NODE_ENV=production"}) {
+		t.Error("environment was wrong:", env)
+	}
+	if _, ok = cfg.exes("nope"); ok {
+		t.Error("there should not be a nope type")
+	}
+
+	want := []string{"js", "css", "img", "audio", "videos", "fonts", "maps", "wasm"}
+	if got := cfg.assetTypes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("types were wrong\nwant: %v\ngot: %v", want, got)
+	}
+}
+
+func TestLoadConfigInvalidTypes(t *testing.T) {
+	t.Parallel()
+
+	dir := filepath.Join(testTmp, "invalid_types")
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, typ := range []string{"js", "__pipedream", ".hidden", "a/b"} {
+		file := filepath.Join(dir, fmt.Sprintf("%d.toml", i))
+		config := fmt.Sprintf("[types.%q]\ncompress_min_size = 1\n", typ)
+		if err := ioutil.WriteFile(file, []byte(config), 0664); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := New(file); err == nil {
+			t.Errorf("%s: expected an error", typ)
+		}
+
+		var p Pipedream
+		if err := p.LoadConfig(file); err == nil {
+			t.Errorf("%s: expected an error from LoadConfig", typ)
+		}
+	}
+}
+
+func TestLoadConfigMissingAsset(t *testing.T) {
+	t.Parallel()
+
+	dir := filepath.Join(testTmp, "missing_asset")
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Value string
+		Valid bool
+	}{
+		{"", true},
+		{MissingAssetPanic, true},
+		{MissingAssetFallback, true},
+		{MissingAssetError, true},
+		{"fallbak", false},
+	}
+
+	for i, test := range tests {
+		file := filepath.Join(dir, fmt.Sprintf("%d.toml", i))
+		config := fmt.Sprintf("missing_asset = %q\n", test.Value)
+		if err := ioutil.WriteFile(file, []byte(config), 0664); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := New(file)
+		if test.Valid && err != nil {
+			t.Errorf("%q: %v", test.Value, err)
+		} else if !test.Valid && err == nil {
+			t.Errorf("%q: expected an error", test.Value)
+		}
+	}
+}
+
+func TestLoadConfigHashes(t *testing.T) {
+	t.Parallel()
+
+	dir := filepath.Join(testTmp, "config_hashes")
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Config string
+		Valid  bool
+	}{
+		{"", true},
+		{`fingerprint_hash = "sha256"`, true},
+		{`integrity_hash = "sha512"`, true},
+		{`fingerprint_hash = "sha-256"`, false},
+		{`integrity_hash = "md5"`, false},
+		{`integrity_hash = "sha-384"`, false},
+	}
+
+	for i, test := range tests {
+		file := filepath.Join(dir, fmt.Sprintf("%d.toml", i))
+		if err := ioutil.WriteFile(file, []byte(test.Config+"\n"), 0664); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := New(file)
+		if test.Valid && err != nil {
+			t.Errorf("%s: %v", test.Config, err)
+		} else if !test.Valid && err == nil {
+			t.Errorf("%s: expected an error", test.Config)
 		}
 	}
 }
@@ -0,0 +1,241 @@
+package pipedream
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+const encodingIdentity = "identity"
+
+// encoding is a compressed copy of each output file
+type encoding struct {
+	Name      string // Content-Encoding token: gzip
+	Extension string // appended to the file name: .gz
+
+	newWriter func(io.Writer) (io.WriteCloser, error)
+}
+
+var (
+	encodingBrotli = encoding{
+		Name:      "br",
+		Extension: ".br",
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return brotli.NewWriterLevel(w, brotli.BestCompression), nil
+		},
+	}
+	encodingZstd = encoding{
+		Name:      "zstd",
+		Extension: ".zst",
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+		},
+	}
+	encodingGzip = encoding{
+		Name:      "gzip",
+		Extension: ".gz",
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriterLevel(w, gzip.BestCompression)
+		},
+	}
+)
+
+// allEncodings is every supported encoding in the order they're preferred
+// when serving
+var allEncodings = []encoding{encodingBrotli, encodingZstd, encodingGzip}
+
+// DefaultCompressible are the MIME types compressed when
+// Pipedream.Compressible is empty. Formats that are already compressed
+// like most images, audio, video and woff fonts gain nothing.
+var DefaultCompressible = []string{
+	"text/*",
+	"application/javascript",
+	"application/json",
+	"application/manifest+json",
+	"application/ld+json",
+	"application/xml",
+	"application/wasm",
+	"application/vnd.ms-fontobject",
+	"application/x-font-ttf",
+	"font/otf",
+	"font/ttf",
+	"image/bmp",
+	"image/svg+xml",
+	"image/x-icon",
+	"image/vnd.microsoft.icon",
+}
+
+// encodings returns the compressed copies to write for each output in the
+// order they're preferred when serving.
+func (p Pipedream) encodings() []encoding {
+	if p.NoCompress {
+		return nil
+	}
+
+	var encs []encoding
+	if p.Brotli {
+		encs = append(encs, encodingBrotli)
+	}
+	if p.Zstd {
+		encs = append(encs, encodingZstd)
+	}
+	encs = append(encs, encodingGzip)
+
+	return encs
+}
+
+// encodingsFor returns the compressed copies to write for an output of typ
+// with a file extension and size, none are written for files that are
+// too small or not a compressible MIME type.
+func (p Pipedream) encodingsFor(typ, extension string, size int64) []encoding {
+	minSize := p.CompressMinSize
+	if exes, ok := p.exes(typ); ok && exes.CompressMinSize != 0 {
+		minSize = exes.CompressMinSize
+	}
+
+	if size < int64(minSize) || !p.compressible(extension) {
+		return nil
+	}
+
+	return p.encodings()
+}
+
+// compressible checks the MIME type of a file extension against the
+// compressible list
+func (p Pipedream) compressible(extension string) bool {
+	mimeType, _, err := mime.ParseMediaType(mime.TypeByExtension("." + extension))
+	if err != nil {
+		return false
+	}
+
+	patterns := p.Compressible
+	if len(patterns) == 0 {
+		patterns = DefaultCompressible
+	}
+
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if pattern == mimeType {
+			return true
+		}
+		if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mimeType, pattern[:len(pattern)-1]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// lookupEncodings returns the encodings for names in the order they're
+// preferred when serving, unknown names are ignored.
+func lookupEncodings(names []string) []encoding {
+	var encs []encoding
+	for _, enc := range allEncodings {
+		for _, name := range names {
+			if enc.Name == name {
+				encs = append(encs, enc)
+				break
+			}
+		}
+	}
+
+	return encs
+}
+
+// parseAcceptEncoding returns the q-value of each coding in an
+// Accept-Encoding header. Codings are lower cased and x-gzip is treated as
+// gzip, codings with a malformed q-value are given a q-value of 0.
+func parseAcceptEncoding(header string) map[string]float64 {
+	qvalues := make(map[string]float64)
+
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if len(coding) == 0 {
+			continue
+		}
+		if coding == "x-gzip" {
+			coding = encodingGzip.Name
+		}
+
+		q := 1.0
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) != 2 || strings.ToLower(strings.TrimSpace(kv[0])) != "q" {
+				continue
+			}
+
+			q = parseQValue(strings.TrimSpace(kv[1]))
+		}
+
+		qvalues[coding] = q
+	}
+
+	return qvalues
+}
+
+// parseQValue parses a weight as defined by RFC 9110 section 12.4.2:
+// 0 to 1 with at most three decimal places. Anything else is 0.
+func parseQValue(s string) float64 {
+	if len(s) == 0 || (s[0] != '0' && s[0] != '1') {
+		return 0
+	}
+	if len(s) > 1 && (s[1] != '.' || len(s) > 5) {
+		return 0
+	}
+
+	q, err := strconv.ParseFloat(s, 64)
+	if err != nil || q < 0 || q > 1 {
+		return 0
+	}
+
+	return q
+}
+
+// negotiateEncoding picks the best of the available encodings for an
+// Accept-Encoding header following RFC 9110 section 12.5.3. The coding
+// with the highest q-value wins, ties go to the earliest in available and
+// identity is preferred least. Identity is acceptable unless excluded by
+// identity;q=0 or *;q=0 but is only used ahead of a coding the client
+// accepts if it's given a higher q-value. Without a header identity is
+// always used.
+//
+// An encoding with an empty name means identity, false is returned if
+// nothing is acceptable.
+func negotiateEncoding(header string, available []encoding) (encoding, bool) {
+	if len(strings.TrimSpace(header)) == 0 {
+		return encoding{}, true
+	}
+
+	qvalues := parseAcceptEncoding(header)
+	qvalue := func(coding string) (float64, bool) {
+		if q, ok := qvalues[coding]; ok {
+			return q, true
+		}
+		if q, ok := qvalues["*"]; ok {
+			return q, true
+		}
+		return 0, false
+	}
+
+	var best encoding
+	bestQ := 0.0
+	for _, enc := range available {
+		if q, _ := qvalue(enc.Name); q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+
+	// Identity that is not mentioned is acceptable but only as a fallback
+	q, mentioned := qvalue(encodingIdentity)
+	if (mentioned && q > bestQ) || (!mentioned && bestQ == 0) {
+		return encoding{}, true
+	}
+
+	return best, bestQ > 0
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package pipedream
+
+import "os/exec"
+
+// killProcessGroup does nothing without process groups, only the command
+// itself is killed when its context is done.
+func killProcessGroup(cmd *exec.Cmd) {}
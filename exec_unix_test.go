@@ -0,0 +1,54 @@
+//go:build unix
+
+package pipedream
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransformTimeoutKillsGroup(t *testing.T) {
+	t.Parallel()
+
+	var p Pipedream
+	p.In = filepath.Join(testTmp, "timeout")
+	p.Out = filepath.Join(testTmp, "timeout_out")
+	p.NoCompress = true
+
+	// The background subshell would write the marker if it outlived the
+	// command it was started by
+	marker := filepath.Join(testTmp, "timeout_marker")
+	p.JS.Minifier = Command{
+		Cmd:     "sh",
+		Args:    []string{"-c", "(sleep 1; echo alive > " + marker + ") & sleep 10"},
+		Stdout:  true,
+		Timeout: Duration(100 * time.Millisecond),
+	}
+
+	inFile := filepath.Join(p.In, "js", "app.js")
+	if err := os.MkdirAll(filepath.Dir(inFile), 0775); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(inFile, []byte(testTransformFile), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, err := p.transform(context.Background(), "js", inFile)
+	if err == nil || !strings.Contains(err.Error(), "timed out after 100ms") {
+		t.Fatal("expected a timeout, got:", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Error("command was not killed in time:", elapsed)
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("child of the command was not killed")
+	}
+}
@@ -1,18 +1,35 @@
 package pipedream
 
 import (
+	"context"
 	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
+const (
+	// DefaultUnhashedCacheControl is the Cache-Control header StaticHandler
+	// sends for files that aren't fingerprinted when
+	// Pipedream.UnhashedCacheControl is empty.
+	DefaultUnhashedCacheControl = "public, no-cache"
+
+	immutableCacheControl = "public, max-age=31536000, immutable"
+)
+
 // StaticHandler serves static assets from the out path encouraging browser
-// caching. StaticHandler disables directory listings. It serves a gzipped
-// file if requested through Accept-Encoding.
+// caching, fingerprinted files are marked immutable and unfingerprinted
+// files use Pipedream.UnhashedCacheControl. StaticHandler disables
+// directory listings. It serves a brotli, zstd or gzipped file if the
+// manifest records one was written and it's preferred through
+// Accept-Encoding, and responds 406 Not Acceptable if neither those nor
+// the identity encoding are acceptable.
 type StaticHandler struct {
 	*Pipedream
 	log *log.Logger
@@ -32,35 +49,41 @@ func (s StaticHandler) logf(format string, v ...interface{}) {
 	}
 }
 
+// cacheControl returns the Cache-Control header for served files.
+// Fingerprinted files never change so they can be cached forever.
+func (s StaticHandler) cacheControl() string {
+	if !s.NoHash {
+		return immutableCacheControl
+	}
+	if len(s.UnhashedCacheControl) != 0 {
+		return s.UnhashedCacheControl
+	}
+
+	return DefaultUnhashedCacheControl
+}
+
 // ServeHTTP serves static assets from the out path.
 func (s StaticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	urlPath := strings.Replace(strings.Replace(r.URL.Path, "..", "", -1), string(os.PathSeparator)+".", "", -1)
 
-	fileDets, ok := s.Manifest.Files[urlPath]
+	fileDets, ok := s.CurrentManifest().Files[urlPath]
 	if !ok {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
-	if !s.NoCompress {
-		acceptEncodings := r.Header.Get("Accept-Encoding")
-		encodings := strings.Split(acceptEncodings, ",")
-		useGzip := false
-		for _, e := range encodings {
-			e = strings.TrimSpace(e)
-			if strings.HasPrefix(e, "gzip") || strings.HasPrefix(e, "*") {
-				useGzip = true
-				break
-			}
-		}
+	encodings := lookupEncodings(fileDets.Encodings)
+	if !s.NoCompress || len(encodings) != 0 {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
 
-		if useGzip {
-			urlPath += ".gz"
-			w.Header().Set("Content-Encoding", "gzip")
-		}
+	enc, ok := negotiateEncoding(r.Header.Get("Accept-Encoding"), encodings)
+	if !ok {
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
 	}
 
-	fileLoc := filepath.Join(s.Out, urlPath)
+	fileLoc := filepath.Join(s.Out, urlPath+enc.Extension)
 	fileStat, err := os.Stat(fileLoc)
 	if os.IsNotExist(err) {
 		w.WriteHeader(http.StatusNotFound)
@@ -83,8 +106,31 @@ func (s StaticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Set("Content-Md5", fileDets.Digest)
-	w.Header().Set("ETag", `"`+fileDets.Digest+`"`)
+	contentType := fileDets.ContentType
+	if len(contentType) == 0 {
+		contentType = mime.TypeByExtension(path.Ext(urlPath))
+	}
+
+	// Each encoding is a different representation so it needs its own
+	// ETag for conditional and range requests to be correct, and the md5
+	// only describes the unencoded file.
+	etag := fileDets.Digest
+	if len(enc.Name) != 0 {
+		etag += "-" + enc.Name
+		w.Header().Set("Content-Encoding", enc.Name)
+		if len(contentType) == 0 {
+			// Don't let ServeContent sniff the compressed bytes
+			contentType = "application/octet-stream"
+		}
+	} else if s.fingerprintHash() == "md5" {
+		w.Header().Set("Content-Md5", fileDets.Digest)
+	}
+
+	if len(contentType) != 0 {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("Cache-Control", s.cacheControl())
+	w.Header().Set("ETag", `"`+etag+`"`)
 	http.ServeContent(w, r, urlPath, fileDets.MTime, file)
 
 	_ = file.Close()
@@ -92,17 +138,27 @@ func (s StaticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 // DynamicHandler automatically recompiles assets that have changed
 // since it last recompiled them. It makes an effort to disable
-// browser-side caching.
+// browser-side caching. When a js or css asset fails to compile the
+// error is displayed on the page instead. Assets are always compiled and
+// served at their unhashed paths, eg. /assets/js/app.js, regardless of
+// NoHash.
 type DynamicHandler struct {
 	*Pipedream
 	log *log.Logger
+
+	// flights is nil if the handler wasn't made by the constructor, every
+	// request then compiles on its own
+	flights *flightGroup
 }
 
-// DynamicHandler returns a DynamicHandler object with a logger
+// DynamicHandler returns a DynamicHandler object with a logger. Concurrent
+// requests for the same stale asset through the returned handler share a
+// single recompile.
 func (p *Pipedream) DynamicHandler(log *log.Logger) http.Handler {
 	return DynamicHandler{
 		Pipedream: p,
 		log:       log,
+		flights:   &flightGroup{},
 	}
 }
 
@@ -238,7 +294,7 @@ func (d DynamicHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// No compilers or minifiers for this asset, serve asset directly
-	if len(exes.Compilers) == 0 && len(exes.Minifier.Cmd) == 0 {
+	if len(exes.Compilers) == 0 && exes.Minifier.isZero() && len(exes.Minifiers) == 0 {
 		fileInfo.outPath = fileInfo.inPath
 		goto ServeFile
 	}
@@ -265,10 +321,18 @@ func (d DynamicHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		goto ServeFile
 	}
 
-	_, err = d.transform(typ, fileInfo.inPath)
-	if err != nil {
+	err = d.flights.do(r.Context(), fileInfo.inPath, func(ctx context.Context) error {
+		unhashed := *d.Pipedream
+		unhashed.NoHash = true
+		_, err := unhashed.transform(ctx, typ, fileInfo.inPath)
+		return err
+	})
+	if r.Context().Err() != nil {
+		// The client went away, there's no one to send an error to
+		return
+	} else if err != nil {
 		d.logf("failed to transform %s: %v", fileInfo.inPath, err)
-		w.WriteHeader(http.StatusInternalServerError)
+		serveError(w, typ, fileInfo.inPath, err)
 		return
 	}
 
@@ -286,3 +350,82 @@ ServeFile:
 	http.ServeContent(w, r, r.URL.Path, time.Now(), file)
 	_ = file.Close()
 }
+
+// flightGroup coalesces concurrent calls with the same key so that only one
+// runs at a time and every caller gets its result.
+type flightGroup struct {
+	mut   sync.Mutex
+	calls map[string]*flight
+}
+
+type flight struct {
+	done      chan struct{}
+	err       error
+	waiters   int
+	cancel    context.CancelFunc
+	cancelled bool
+}
+
+// do runs fn unless a call for key is already running, in which case it
+// waits for that call and returns its error instead. The context passed to
+// fn is done once every caller waiting on it has given up. A call that has
+// been cancelled is left to finish before another one for key starts so
+// two are never running at once. A nil group runs fn straight away.
+func (g *flightGroup) do(ctx context.Context, key string, fn func(context.Context) error) error {
+	if g == nil {
+		return fn(ctx)
+	}
+
+	for {
+		g.mut.Lock()
+		if g.calls == nil {
+			g.calls = make(map[string]*flight)
+		}
+
+		f, ok := g.calls[key]
+		if ok && f.cancelled {
+			g.mut.Unlock()
+
+			select {
+			case <-f.done:
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		if !ok {
+			fctx, cancel := context.WithCancel(context.Background())
+			f = &flight{done: make(chan struct{}), cancel: cancel}
+			g.calls[key] = f
+
+			go func() {
+				f.err = fn(fctx)
+				cancel()
+
+				g.mut.Lock()
+				delete(g.calls, key)
+				g.mut.Unlock()
+
+				close(f.done)
+			}()
+		}
+		f.waiters++
+		g.mut.Unlock()
+
+		select {
+		case <-f.done:
+			return f.err
+		case <-ctx.Done():
+			g.mut.Lock()
+			f.waiters--
+			if f.waiters == 0 {
+				f.cancelled = true
+				f.cancel()
+			}
+			g.mut.Unlock()
+
+			return ctx.Err()
+		}
+	}
+}
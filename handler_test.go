@@ -1,11 +1,14 @@
 package pipedream
 
 import (
+	"context"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -15,6 +18,8 @@ func TestStaticHandler(t *testing.T) {
 
 	outFile1 := filepath.Join(testTmp, "static", "assets", "js", "transform_file-a1b2c3.js")
 	outFile2 := filepath.Join(testTmp, "static", "assets", "css", "transform_file-a1b2c3.css.gz")
+	outFile3 := filepath.Join(testTmp, "static", "assets", "css", "transform_file-a1b2c3.css.br")
+	outFile4 := filepath.Join(testTmp, "static", "assets", "css", "transform_file-a1b2c3.css.zst")
 
 	if err := os.MkdirAll(filepath.Join(testTmp, "static", "assets", "js"), 0775); err != nil {
 		t.Error(err)
@@ -29,6 +34,12 @@ func TestStaticHandler(t *testing.T) {
 	if err := ioutil.WriteFile(outFile2, []byte(testTransformFileGZ), 0664); err != nil {
 		t.Fatal(err)
 	}
+	if err := ioutil.WriteFile(outFile3, []byte(testTransformFileBR), 0664); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(outFile4, []byte(testTransformFileZST), 0664); err != nil {
+		t.Fatal(err)
+	}
 
 	var p Pipedream
 	p.Out = filepath.Join(testTmp, "static")
@@ -39,9 +50,10 @@ func TestStaticHandler(t *testing.T) {
 			Digest: "a1b2c3",
 		},
 		"/assets/css/transform_file-a1b2c3.css": FileInfo{
-			MTime:  time.Now(),
-			Size:   uint64(len(testTransformFile)),
-			Digest: "a1b2c3",
+			MTime:     time.Now(),
+			Size:      uint64(len(testTransformFile)),
+			Digest:    "a1b2c3",
+			Encodings: []string{"gzip"},
 		},
 	}
 
@@ -67,6 +79,14 @@ func TestStaticHandler(t *testing.T) {
 			t.Error("etag was wrong:", etag)
 		}
 
+		if cc := w.Header().Get("Cache-Control"); cc != "public, max-age=31536000, immutable" {
+			t.Error("cache control was wrong:", cc)
+		}
+
+		if vary := w.Header().Get("Vary"); vary != "Accept-Encoding" {
+			t.Error("vary was wrong:", vary)
+		}
+
 		if bs := w.Body.String(); bs != testTransformFile {
 			t.Errorf("body mismatch, got:\n%s", bs)
 		}
@@ -89,18 +109,76 @@ func TestStaticHandler(t *testing.T) {
 			t.Error("wanted gzip, got:", cEnc)
 		}
 
+		if ct := w.Header().Get("Content-Type"); ct != "text/css; charset=utf-8" {
+			t.Error("content type was wrong:", ct)
+		}
+
+		if etag := w.Header().Get("ETag"); etag != `"a1b2c3-gzip"` {
+			t.Error("etag was wrong:", etag)
+		}
+
+		if md5 := w.Header().Get("Content-Md5"); md5 != "" {
+			t.Error("content-md5 should not be set for encoded files:", md5)
+		}
+
 		if bs := w.Body.String(); bs != testTransformFileGZ {
 			t.Errorf("body mismatch, got:\n%s", bs)
 		}
 
 	})
 
+	t.Run("GzipRange", func(t *testing.T) {
+		t.Parallel()
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/assets/css/transform_file-a1b2c3.css", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		r.Header.Set("Range", "bytes=1-8")
+		r.Header.Set("If-Range", `"a1b2c3-gzip"`)
+		p.StaticHandler(nil).ServeHTTP(w, r)
+
+		if w.Code != http.StatusPartialContent {
+			t.Fatal("wanted status partial content, got:", w.Code)
+		}
+
+		if cEnc := w.Header().Get("Content-Encoding"); cEnc != "gzip" {
+			t.Error("wanted gzip, got:", cEnc)
+		}
+
+		if ct := w.Header().Get("Content-Type"); ct != "text/css; charset=utf-8" {
+			t.Error("content type was wrong:", ct)
+		}
+
+		if bs := w.Body.String(); bs != testTransformFileGZ[1:9] {
+			t.Errorf("body mismatch, got:\n%s", bs)
+		}
+	})
+
+	t.Run("RangeWrongEncodingETag", func(t *testing.T) {
+		t.Parallel()
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/assets/css/transform_file-a1b2c3.css", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		r.Header.Set("Range", "bytes=1-8")
+		r.Header.Set("If-Range", `"a1b2c3"`)
+		p.StaticHandler(nil).ServeHTTP(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Fatal("wanted the full file, got:", w.Code)
+		}
+
+		if bs := w.Body.String(); bs != testTransformFileGZ {
+			t.Errorf("body mismatch, got:\n%s", bs)
+		}
+	})
+
 	t.Run("GzipStar", func(t *testing.T) {
 		t.Parallel()
 
 		w := httptest.NewRecorder()
 		r := httptest.NewRequest("GET", "/assets/css/transform_file-a1b2c3.css", nil)
-		r.Header.Set("Accept-Encoding", "identity; q=0.5, *;q=0")
+		r.Header.Set("Accept-Encoding", "identity; q=0.5, *")
 		p.StaticHandler(nil).ServeHTTP(w, r)
 
 		if w.Code != http.StatusOK {
@@ -117,6 +195,148 @@ func TestStaticHandler(t *testing.T) {
 		}
 	})
 
+	t.Run("GzipStarRejected", func(t *testing.T) {
+		t.Parallel()
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/assets/js/transform_file-a1b2c3.js", nil)
+		r.Header.Set("Accept-Encoding", "identity; q=0.5, *;q=0")
+		p.StaticHandler(nil).ServeHTTP(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Fatal("wanted status ok, got:", w.Code)
+		}
+
+		if cEnc := w.Header().Get("Content-Encoding"); cEnc != "" {
+			t.Error("wanted no content encoding, got:", cEnc)
+		}
+
+		if bs := w.Body.String(); bs != testTransformFile {
+			t.Errorf("body mismatch, got:\n%s", bs)
+		}
+	})
+
+	t.Run("NoEncodingsWritten", func(t *testing.T) {
+		t.Parallel()
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/assets/js/transform_file-a1b2c3.js", nil)
+		r.Header.Set("Accept-Encoding", "gzip, br, zstd")
+		p.StaticHandler(nil).ServeHTTP(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Fatal("wanted status ok, got:", w.Code)
+		}
+
+		if cEnc := w.Header().Get("Content-Encoding"); cEnc != "" {
+			t.Error("wanted no content encoding, got:", cEnc)
+		}
+
+		if bs := w.Body.String(); bs != testTransformFile {
+			t.Errorf("body mismatch, got:\n%s", bs)
+		}
+	})
+
+	t.Run("Encodings", func(t *testing.T) {
+		t.Parallel()
+
+		var q Pipedream
+		q.Out = p.Out
+		q.Manifest.Files = map[string]FileInfo{
+			"/assets/css/transform_file-a1b2c3.css": FileInfo{
+				MTime:     time.Now(),
+				Size:      uint64(len(testTransformFile)),
+				Digest:    "a1b2c3",
+				Encodings: []string{"gzip", "zstd", "br"},
+			},
+		}
+
+		tests := []struct {
+			AcceptEncoding string
+			Encoding       string
+			Body           string
+		}{
+			{"gzip, br", "br", testTransformFileBR},
+			{"gzip;q=1.0, br;q=0.8", "gzip", testTransformFileGZ},
+			{"gzip, zstd", "zstd", testTransformFileZST},
+			{"*", "br", testTransformFileBR},
+		}
+
+		for _, test := range tests {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/assets/css/transform_file-a1b2c3.css", nil)
+			r.Header.Set("Accept-Encoding", test.AcceptEncoding)
+			q.StaticHandler(nil).ServeHTTP(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s: wanted status ok, got: %d", test.AcceptEncoding, w.Code)
+			}
+
+			if cEnc := w.Header().Get("Content-Encoding"); cEnc != test.Encoding {
+				t.Errorf("%s: wanted %s, got: %s", test.AcceptEncoding, test.Encoding, cEnc)
+			}
+
+			if vary := w.Header().Get("Vary"); vary != "Accept-Encoding" {
+				t.Errorf("%s: vary was wrong: %s", test.AcceptEncoding, vary)
+			}
+
+			if bs := w.Body.String(); bs != test.Body {
+				t.Errorf("%s: body mismatch, got:\n%s", test.AcceptEncoding, bs)
+			}
+		}
+	})
+
+	t.Run("CacheControl", func(t *testing.T) {
+		t.Parallel()
+
+		tests := []struct {
+			NoHash       bool
+			NoCompress   bool
+			CacheControl string
+			Want         string
+			Vary         string
+		}{
+			{false, false, "", "public, max-age=31536000, immutable", "Accept-Encoding"},
+			{false, false, "public, max-age=60", "public, max-age=31536000, immutable", "Accept-Encoding"},
+			{true, false, "", "public, no-cache", "Accept-Encoding"},
+			{true, true, "public, max-age=3600", "public, max-age=3600", ""},
+		}
+
+		for i, test := range tests {
+			q := p
+			q.NoHash = test.NoHash
+			q.NoCompress = test.NoCompress
+			q.UnhashedCacheControl = test.CacheControl
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/assets/js/transform_file-a1b2c3.js", nil)
+			q.StaticHandler(nil).ServeHTTP(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("%d) wanted status ok, got: %d", i, w.Code)
+			}
+			if cc := w.Header().Get("Cache-Control"); cc != test.Want {
+				t.Errorf("%d) cache control was wrong: %s", i, cc)
+			}
+			if vary := w.Header().Get("Vary"); vary != test.Vary {
+				t.Errorf("%d) vary was wrong: %s", i, vary)
+			}
+		}
+	})
+
+	t.Run("NotAcceptable", func(t *testing.T) {
+		t.Parallel()
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/assets/css/transform_file-a1b2c3.css", nil)
+		r.Header.Set("Accept-Encoding", "br, identity;q=0")
+		p.StaticHandler(nil).ServeHTTP(w, r)
+
+		if w.Code != http.StatusNotAcceptable {
+			t.Fatal("wanted 406, got:", w.Code)
+		}
+	})
+
 	t.Run("PreventFolderTraversal", func(t *testing.T) {
 		t.Parallel()
 
@@ -142,6 +362,209 @@ func TestStaticHandler(t *testing.T) {
 	})
 }
 
+func TestNegotiateEncoding(t *testing.T) {
+	t.Parallel()
+
+	all := []encoding{encodingBrotli, encodingZstd, encodingGzip}
+	gzipOnly := []encoding{encodingGzip}
+
+	tests := []struct {
+		Header    string
+		Available []encoding
+		Encoding  string
+		OK        bool
+	}{
+		// No preference or nothing to choose from
+		{"", all, "", true},
+		{"   ", all, "", true},
+		{"gzip", nil, "", true},
+		{"identity", all, "", true},
+
+		// Server preference breaks ties
+		{"gzip, br, zstd", all, "br", true},
+		{"gzip, zstd", all, "zstd", true},
+		{"gzip, identity", all, "gzip", true},
+		{"*", all, "br", true},
+		{"*", gzipOnly, "gzip", true},
+
+		// Client q-values win over server preference
+		{"br;q=0.5, gzip", all, "gzip", true},
+		{"gzip;q=0.9, zstd;q=0.8, br;q=0.1", all, "gzip", true},
+		{"gzip;q=0.5, identity", all, "", true},
+		{"GZIP;Q=0.5", all, "gzip", true},
+		{"x-gzip", all, "gzip", true},
+
+		// q=0 excludes a coding
+		{"gzip;q=0", gzipOnly, "", true},
+		{"gzip;q=0.000, br", gzipOnly, "", true},
+		{"*;q=0", gzipOnly, "", false},
+		{"identity;q=0.5, *;q=0", all, "", true},
+		{"gzip;q=1.0, identity; q=0.5, *;q=0", all, "gzip", true},
+		{"br, *;q=0", gzipOnly, "", false},
+		{"identity;q=0", gzipOnly, "", false},
+		{"identity;q=0", all, "", false},
+		{"gzip, identity;q=0", all, "gzip", true},
+		{"*;q=0", all, "", false},
+		{"*;q=0, identity", all, "", true},
+
+		// Malformed q-values are not acceptable
+		{"gzip;q=2", gzipOnly, "", true},
+		{"gzip;q=0.1234", gzipOnly, "", true},
+		{"gzip;q=abc, br", all, "br", true},
+		{"gzip;q=.5", gzipOnly, "", true},
+		{"gzip;q=1.000", gzipOnly, "gzip", true},
+	}
+
+	for i, test := range tests {
+		enc, ok := negotiateEncoding(test.Header, test.Available)
+		if enc.Name != test.Encoding || ok != test.OK {
+			t.Errorf("%d) %q: wanted %q %t, got %q %t", i, test.Header, test.Encoding, test.OK, enc.Name, ok)
+		}
+	}
+}
+
+func TestFlightGroupCancel(t *testing.T) {
+	t.Parallel()
+
+	var g flightGroup
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+
+	fn := func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		close(cancelled)
+		return ctx.Err()
+	}
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+
+	errs := make(chan error, 2)
+	go func() { errs <- g.do(ctx1, "key", fn) }()
+	<-started
+	go func() { errs <- g.do(ctx2, "key", fn) }()
+
+	// Wait for the second caller to join the flight
+	for {
+		g.mut.Lock()
+		waiters := g.calls["key"].waiters
+		g.mut.Unlock()
+		if waiters == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel1()
+	if err := <-errs; err != context.Canceled {
+		t.Error("expected the first caller to be cancelled, got:", err)
+	}
+
+	select {
+	case <-cancelled:
+		t.Fatal("flight was cancelled while a caller was still waiting")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel2()
+	if err := <-errs; err != context.Canceled {
+		t.Error("expected the second caller to be cancelled, got:", err)
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("flight was not cancelled once every caller gave up")
+	}
+}
+
+func TestFlightGroupCancelledStillRunning(t *testing.T) {
+	t.Parallel()
+
+	var g flightGroup
+	var running int32
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+
+	// fn ignores cancellation for a while like a transform writing output
+	fn := func(ctx context.Context) error {
+		if atomic.AddInt32(&running, 1) != 1 {
+			t.Error("two calls for the same key ran at once")
+		}
+		started <- struct{}{}
+		<-release
+		atomic.AddInt32(&running, -1)
+		return nil
+	}
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	errs := make(chan error, 2)
+	go func() { errs <- g.do(ctx1, "key", fn) }()
+	<-started
+
+	cancel1()
+	if err := <-errs; err != context.Canceled {
+		t.Error("expected the first caller to be cancelled, got:", err)
+	}
+
+	go func() { errs <- g.do(context.Background(), "key", fn) }()
+
+	select {
+	case <-started:
+		t.Fatal("second call started while the cancelled one was running")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release <- struct{}{}
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("second call never started")
+	}
+	close(release)
+
+	if err := <-errs; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDynamicHandlerLiteral(t *testing.T) {
+	t.Parallel()
+
+	inFile := filepath.Join(testTmp, "dynamic_literal", "assets", "js", "app.js")
+	if err := os.MkdirAll(filepath.Dir(inFile), 0775); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(inFile, []byte(testTransformFile), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	var p Pipedream
+	p.In = filepath.Join(testTmp, "dynamic_literal", "assets")
+	p.Out = filepath.Join(testTmp, "dynamic_literal", "cached")
+	p.NoCompress = true
+	p.JS.Minifier = Command{
+		Cmd:    "cat",
+		Args:   []string{"$infile"},
+		Stdout: true,
+	}
+
+	// Handlers made without the constructor have no flight group
+	handler := DynamicHandler{Pipedream: &p}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/assets/js/app.js", nil)
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatal("wanted status ok, got:", w.Code)
+	}
+	if w.Body.String() != testTransformFile {
+		t.Errorf("body was wrong:\n%s", w.Body.String())
+	}
+}
+
 func TestDynamicHandler(t *testing.T) {
 	t.Parallel()
 
@@ -322,6 +745,158 @@ func TestDynamicHandler(t *testing.T) {
 		}
 	})
 
+	t.Run("CompileErrorOverlay", func(t *testing.T) {
+		fail := map[string]Command{
+			"fail": Command{
+				Cmd:  "sh",
+				Args: []string{"-c", "echo 'syntax error on line 3' >&2; exit 1"},
+			},
+		}
+		p.JS.Compilers = fail
+		p.JS.Minifier = Command{}
+		p.Img.Compilers = fail
+
+		if err := os.MkdirAll(filepath.Join(testTmp, "dynamic", "assets", "img"), 0775); err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			File        string
+			Status      int
+			ContentType string
+		}{
+			{"js/broken.js", http.StatusOK, "application/javascript; charset=utf-8"},
+			{"img/broken.svg", http.StatusInternalServerError, "text/plain; charset=utf-8"},
+		}
+
+		for _, test := range tests {
+			inFile := filepath.Join(testTmp, "dynamic", "assets", filepath.FromSlash(test.File)+".fail")
+			if err := ioutil.WriteFile(inFile, []byte(testTransformFile), 0664); err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/assets/"+test.File, nil)
+			p.DynamicHandler(nil).ServeHTTP(w, r)
+
+			if w.Code != test.Status {
+				t.Errorf("%s: wanted status %d, got: %d", test.File, test.Status, w.Code)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != test.ContentType {
+				t.Errorf("%s: content type was wrong: %s", test.File, ct)
+			}
+			if bs := w.Body.String(); !strings.Contains(bs, "syntax error on line 3") {
+				t.Errorf("%s: body did not contain the compiler output:\n%s", test.File, bs)
+			}
+		}
+
+		p.Img.Compilers = nil
+	})
+
+	t.Run("CoalesceRecompiles", func(t *testing.T) {
+		counter := filepath.Join(testTmp, "dynamic", "coalesce_count")
+		p.JS.Compilers = map[string]Command{
+			"slow": Command{
+				Cmd:    "sh",
+				Args:   []string{"-c", `echo >> "$0"; sleep 0.2; cat`, counter},
+				Stdin:  true,
+				Stdout: true,
+			},
+		}
+		p.JS.Minifier = Command{}
+
+		inFile := filepath.Join(testTmp, "dynamic", "assets", "js", "transform_file4.js.slow")
+		if err := ioutil.WriteFile(inFile, []byte(testTransformFile), 0664); err != nil {
+			t.Fatal(err)
+		}
+
+		handler := p.DynamicHandler(nil)
+		codes := make(chan int)
+		for i := 0; i < 5; i++ {
+			go func() {
+				w := httptest.NewRecorder()
+				r := httptest.NewRequest("GET", "/assets/js/transform_file4.js", nil)
+				handler.ServeHTTP(w, r)
+				codes <- w.Code
+			}()
+		}
+
+		for i := 0; i < 5; i++ {
+			if code := <-codes; code != http.StatusOK {
+				t.Error("wanted status ok, got:", code)
+			}
+		}
+
+		b, err := ioutil.ReadFile(counter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) != 1 {
+			t.Errorf("compiler should have run once, ran: %d", len(b))
+		}
+	})
+
+	t.Run("CustomType", func(t *testing.T) {
+		p.Types = map[string]Exes{
+			"wasm": {Compilers: map[string]Command{
+				"cat": {Cmd: "cat", Stdin: true, Stdout: true},
+			}},
+		}
+		defer func() { p.Types = nil }()
+
+		if err := os.MkdirAll(filepath.Join(testTmp, "dynamic", "assets", "wasm"), 0775); err != nil {
+			t.Fatal(err)
+		}
+		inFile := filepath.Join(testTmp, "dynamic", "assets", "wasm", "app.wasm.cat")
+		if err := ioutil.WriteFile(inFile, []byte(testTransformFile), 0664); err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/assets/wasm/app.wasm", nil)
+		p.DynamicHandler(nil).ServeHTTP(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Fatal("wanted status ok, got:", w.Code)
+		}
+		if bs := w.Body.String(); bs != testTransformFile {
+			t.Errorf("body mismatch, got:\n%s", bs)
+		}
+	})
+
+	t.Run("Fingerprinting", func(t *testing.T) {
+		p.JS.Compilers = map[string]Command{}
+		p.JS.Minifier = Command{Cmd: "cat", Args: []string{"$infile"}, Stdout: true}
+		p.NoHash = false
+		defer func() { p.NoHash = true }()
+
+		inFile := filepath.Join(testTmp, "dynamic", "assets", "js", "hashed.js")
+		if err := ioutil.WriteFile(inFile, []byte(testTransformFile), 0664); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 2; i++ {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/assets/js/hashed.js", nil)
+			p.DynamicHandler(nil).ServeHTTP(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Fatal("wanted status ok, got:", w.Code)
+			}
+			if bs := w.Body.String(); bs != testTransformFile {
+				t.Errorf("body mismatch, got:\n%s", bs)
+			}
+		}
+
+		hashed, err := filepath.Glob(filepath.Join(testTmp, "dynamic", "cached", "assets", "js", "hashed-*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hashed) != 0 {
+			t.Error("fingerprinted copies were written:", hashed)
+		}
+	})
+
 	t.Run("BadTypeNotFound", func(t *testing.T) {
 		p.JS.Compilers = map[string]Command{}
 		p.JS.Minifier = Command{}
@@ -0,0 +1,75 @@
+package pipedream
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"hash"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultFingerprintHash is used for file name fingerprints when
+	// Pipedream.FingerprintHash is empty
+	DefaultFingerprintHash = "md5"
+	// DefaultIntegrityHash is used for Subresource Integrity when
+	// Pipedream.IntegrityHash is empty
+	DefaultIntegrityHash = "sha384"
+)
+
+var hashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+// integrityHashes are the algorithms allowed by Subresource Integrity
+var integrityHashes = map[string]bool{
+	"sha256": true,
+	"sha384": true,
+	"sha512": true,
+}
+
+func (p Pipedream) fingerprintHash() string {
+	if len(p.FingerprintHash) == 0 {
+		return DefaultFingerprintHash
+	}
+	return p.FingerprintHash
+}
+
+func (p Pipedream) integrityHash() string {
+	if len(p.IntegrityHash) == 0 {
+		return DefaultIntegrityHash
+	}
+	return p.IntegrityHash
+}
+
+// newFingerprint returns the hash used for file name fingerprints
+func (p Pipedream) newFingerprint() (hash.Hash, error) {
+	newHash, ok := hashes[p.fingerprintHash()]
+	if !ok {
+		return nil, errors.Errorf("unknown fingerprint hash: %s", p.fingerprintHash())
+	}
+
+	return newHash(), nil
+}
+
+// newIntegrity returns the hash used for Subresource Integrity
+func (p Pipedream) newIntegrity() (hash.Hash, error) {
+	name := p.integrityHash()
+	if !integrityHashes[name] {
+		return nil, errors.Errorf("unsupported integrity hash: %s", name)
+	}
+
+	return hashes[name](), nil
+}
+
+// integrity formats a hash as a Subresource Integrity value: sha384-base64
+func (p Pipedream) integrity(h hash.Hash) string {
+	return p.integrityHash() + "-" + base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
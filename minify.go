@@ -0,0 +1,50 @@
+package pipedream
+
+import (
+	"context"
+	"io"
+
+	"github.com/tdewolff/minify/v2"
+	"github.com/tdewolff/minify/v2/css"
+	"github.com/tdewolff/minify/v2/html"
+	"github.com/tdewolff/minify/v2/js"
+	"github.com/tdewolff/minify/v2/json"
+	"github.com/tdewolff/minify/v2/svg"
+)
+
+// builtinMediaTypes maps the names of the built in minifiers that can be used
+// in the builtin key of a Command to the media type they minify.
+var builtinMediaTypes = map[string]string{
+	"css":  "text/css",
+	"js":   "application/javascript",
+	"svg":  "image/svg+xml",
+	"json": "application/json",
+	"html": "text/html",
+}
+
+// builtinMinify has every built in minifier registered so html and svg can
+// minify the css and js embedded in them.
+var builtinMinify = newBuiltinMinify()
+
+func newBuiltinMinify() *minify.M {
+	m := minify.New()
+	m.AddFunc("text/css", css.Minify)
+	m.AddFunc("application/javascript", js.Minify)
+	m.AddFunc("image/svg+xml", svg.Minify)
+	m.AddFunc("application/json", json.Minify)
+	m.AddFunc("text/html", html.Minify)
+
+	return m
+}
+
+// builtinTransformer returns the built in minifier called name
+func builtinTransformer(name string) (Transformer, bool) {
+	mediaType, ok := builtinMediaTypes[name]
+	if !ok {
+		return nil, false
+	}
+
+	return TransformerFunc(func(ctx context.Context, typ string, in io.Reader, out io.Writer) error {
+		return builtinMinify.Minify(mediaType, out, in)
+	}), true
+}
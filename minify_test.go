@@ -0,0 +1,99 @@
+package pipedream
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+var testBuiltinConfig = `
+[js]
+minifier = { builtin = "js" }
+
+[css]
+minifier = { builtin = "css" }
+
+[img.minifiers]
+svg = { builtin = "svg" }
+
+[types.data]
+minifier = { builtin = "json" }
+
+[types.pages]
+minifier = { builtin = "html" }
+`
+
+func TestBuiltinMinifiers(t *testing.T) {
+	t.Parallel()
+
+	var p Pipedream
+	if _, err := toml.Decode(testBuiltinConfig, &p); err != nil {
+		t.Fatal(err)
+	}
+	p.In = filepath.Join(testTmp, "builtin")
+	p.Out = filepath.Join(testTmp, "builtin_out")
+	p.NoCompress = true
+
+	tests := []struct {
+		File string
+		In   string
+		Want string
+	}{
+		{"js/app.js", "function add(first, second) {\n\t// sum\n\treturn first + second;\n}\n", "function add(e,t){return e+t}"},
+		{"css/app.css", "body {\n\tcolor: #ff0000;\n\tmargin: 0px;\n}\n", "body{color:red;margin:0}"},
+		{"img/icon.svg", "<svg xmlns=\"http://www.w3.org/2000/svg\">\n\t<!-- icon -->\n\t<rect width=\"10\" height=\"10\" />\n</svg>\n", `<svg xmlns="http://www.w3.org/2000/svg"><rect width="10" height="10"/></svg>`},
+		{"data/config.json", "{\n\t\"a\": 1,\n\t\"b\": [1, 2]\n}\n", `{"a":1,"b":[1,2]}`},
+		{"pages/index.html", "<html>\n\t<body>\n\t\t<!-- page -->\n\t\t<p class=\"x\">hi</p>\n\t</body>\n</html>\n", `<p class=x>hi`},
+	}
+
+	for _, test := range tests {
+		inFile := filepath.Join(p.In, filepath.FromSlash(test.File))
+		if err := os.MkdirAll(filepath.Dir(inFile), 0775); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(inFile, []byte(test.In), 0664); err != nil {
+			t.Fatal(err)
+		}
+
+		outs, err := p.transform(context.Background(), filepath.Dir(filepath.FromSlash(test.File)), inFile)
+		if err != nil {
+			t.Errorf("%s: %v", test.File, err)
+			continue
+		}
+
+		b, err := ioutil.ReadFile(outs[0].Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(b) != test.Want {
+			t.Errorf("%s: file was wrong\nwant: %s\ngot:  %s", test.File, test.Want, b)
+		}
+	}
+}
+
+func TestBuiltinMinifierUnknown(t *testing.T) {
+	t.Parallel()
+
+	var p Pipedream
+	p.In = filepath.Join(testTmp, "builtin_unknown")
+	p.Out = filepath.Join(testTmp, "builtin_unknown_out")
+	p.NoCompress = true
+	p.JS.Minifier = Command{Builtin: "coffee"}
+
+	inFile := filepath.Join(p.In, "js", "app.js")
+	if err := os.MkdirAll(filepath.Dir(inFile), 0775); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(inFile, []byte("var a = 1;"), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.transform(context.Background(), "js", inFile); err == nil {
+		t.Error("expected an error for an unknown builtin")
+	}
+}
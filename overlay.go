@@ -0,0 +1,98 @@
+package pipedream
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// serveError responds to a failed transform. Browsers refuse to run
+// scripts and stylesheets that come back with an error status, so js and
+// css are sent with 200 OK and a payload that displays the error on the
+// page. Other types get the error as plain text.
+func serveError(w http.ResponseWriter, typ, file string, err error) {
+	msg := fmt.Sprintf("pipedream: failed to compile %s\n\n%v", file, err)
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	switch typ {
+	case typeJS:
+		w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(jsOverlay(msg))
+	case typeCSS:
+		w.Header().Set("Content-Type", "text/css; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(cssOverlay(msg))
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(msg))
+	}
+}
+
+// jsOverlay returns a script that covers the page with msg
+func jsOverlay(msg string) []byte {
+	quoted, _ := json.Marshal(msg)
+
+	return []byte(`(function() {
+	var msg = ` + string(quoted) + `;
+	if (window.console) {
+		console.error(msg);
+	}
+
+	function show() {
+		var overlay = document.createElement("pre");
+		overlay.setAttribute("style", "` + overlayStyle + `");
+		overlay.textContent = msg;
+		overlay.onclick = function() {
+			overlay.parentNode.removeChild(overlay);
+		};
+		document.body.appendChild(overlay);
+	}
+
+	if (document.body) {
+		show();
+	} else {
+		document.addEventListener("DOMContentLoaded", show);
+	}
+})();
+`)
+}
+
+// cssOverlay returns a stylesheet that covers the page with msg
+func cssOverlay(msg string) []byte {
+	return []byte(`body::before {
+	content: ` + cssString(msg) + `;
+	` + strings.Replace(overlayStyle, "; ", ";\n\t", -1) + `
+}
+`)
+}
+
+const overlayStyle = "position: fixed; top: 0; left: 0; right: 0; bottom: 0; z-index: 2147483647; " +
+	"margin: 0; padding: 2em; overflow: auto; white-space: pre-wrap; " +
+	"font: 14px/1.4 monospace; color: #e8e8e8; background: rgba(24, 24, 24, 0.95);"
+
+// cssString quotes s for use as a css string
+func cssString(s string) string {
+	buf := &bytes.Buffer{}
+	buf.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			buf.WriteByte('\\')
+			buf.WriteRune(r)
+		case r == '\n':
+			buf.WriteString(`\A `)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(buf, `\%x `, r)
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	buf.WriteByte('"')
+
+	return buf.String()
+}
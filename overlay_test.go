@@ -0,0 +1,24 @@
+package pipedream
+
+import "testing"
+
+func TestCSSString(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		In  string
+		Out string
+	}{
+		{`plain`, `"plain"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{`C:\path`, `"C:\\path"`},
+		{"line\nbreak", `"line\A break"`},
+		{"tab\there", `"tab\9 here"`},
+	}
+
+	for i, test := range tests {
+		if got := cssString(test.In); got != test.Out {
+			t.Errorf("%d) want: %s, got: %s", i, test.Out, got)
+		}
+	}
+}
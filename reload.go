@@ -0,0 +1,171 @@
+package pipedream
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+const (
+	// ReloadEventsPath is the url of the Server-Sent Events stream served
+	// by ReloadHandler.
+	ReloadEventsPath = "/assets/__pipedream/events"
+	// ReloadScriptPath is the url of the live reload client script served
+	// by ReloadHandler, include it in a page with a script tag.
+	ReloadScriptPath = "/assets/__pipedream/reload.js"
+)
+
+// ReloadHandler pushes a Watcher's events to browsers using Server-Sent
+// Events and serves a client script that reloads the page when an asset
+// changes. Stylesheets are swapped in place without reloading the page.
+type ReloadHandler struct {
+	*Watcher
+}
+
+// ReloadHandler returns a ReloadHandler for the watcher's events, it should
+// be mounted in front of the DynamicHandler.
+func (w *Watcher) ReloadHandler() http.Handler {
+	return ReloadHandler{Watcher: w}
+}
+
+// reloadMessage is the data of each event sent to the client script
+type reloadMessage struct {
+	Type    string `json:"type"`
+	Asset   string `json:"asset,omitempty"`
+	URL     string `json:"url,omitempty"`
+	Source  string `json:"source,omitempty"`
+	Removed bool   `json:"removed,omitempty"`
+}
+
+// ServeHTTP serves the event stream and client script.
+func (rh ReloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case ReloadScriptPath:
+		w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		_, _ = io.WriteString(w, reloadScript)
+	case ReloadEventsPath:
+		rh.serveEvents(w, r)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (rh ReloadHandler) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		rh.logf("response writer does not support flushing, cannot stream events")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	events, unsubscribe := rh.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	_, _ = io.WriteString(w, ": connected\n\n")
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+
+			for _, msg := range rh.reloadMessages(e) {
+				b, err := json.Marshal(msg)
+				if err != nil {
+					rh.logf("failed to marshal reload message: %v", err)
+					continue
+				}
+
+				if _, err = fmt.Fprintf(w, "event: change\ndata: %s\n\n", b); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// reloadMessages turns an event into a message per changed asset, assets
+// that failed to compile are left out.
+func (rh ReloadHandler) reloadMessages(e Event) []reloadMessage {
+	if e.Removed {
+		return []reloadMessage{{Type: e.Type, Source: e.Source, Removed: true}}
+	}
+
+	var msgs []reloadMessage
+	for _, r := range e.Results {
+		if r.Err != nil {
+			continue
+		}
+
+		// Uncompiled sources are served by the DynamicHandler, not the CDN
+		url := r.Output
+		if !rh.NotifyOnly {
+			url = rh.CDNURL + url
+		}
+
+		msgs = append(msgs, reloadMessage{
+			Type:  r.Type,
+			Asset: r.Asset,
+			URL:   url,
+		})
+	}
+
+	return msgs
+}
+
+// reloadScript connects to the event stream. Changed stylesheets have their
+// link swapped for the new url, any other change reloads the page.
+const reloadScript = `(function() {
+	if (!window.EventSource) {
+		return;
+	}
+
+	var fingerprint = /-[0-9a-f]{32,128}(\.[^.\/]*)$/;
+
+	function assetPath(href) {
+		var a = document.createElement("a");
+		a.href = href;
+		return a.pathname.replace(fingerprint, "$1");
+	}
+
+	function swapCSS(msg) {
+		var want = "/assets/" + msg.asset;
+		var links = document.querySelectorAll("link[rel=stylesheet]");
+		var swapped = false;
+
+		for (var i = 0; i < links.length; i++) {
+			if (assetPath(links[i].href) !== want) {
+				continue;
+			}
+
+			var sep = msg.url.indexOf("?") === -1 ? "?" : "&";
+			links[i].href = msg.url + sep + "pipedream=" + Date.now();
+			swapped = true;
+		}
+
+		return swapped;
+	}
+
+	var events = new EventSource("` + ReloadEventsPath + `");
+	events.addEventListener("change", function(e) {
+		var msg = JSON.parse(e.data);
+
+		if (msg.type === "css" && !msg.removed && swapCSS(msg)) {
+			return;
+		}
+
+		window.location.reload();
+	});
+})();
+`
@@ -0,0 +1,188 @@
+package pipedream
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReloadHandler(t *testing.T) {
+	t.Parallel()
+
+	var p Pipedream
+	w := p.Watcher(nil)
+
+	server := httptest.NewServer(w.ReloadHandler())
+	defer server.Close()
+
+	t.Run("Script", func(t *testing.T) {
+		resp, err := http.Get(server.URL + ReloadScriptPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatal("wanted status ok, got:", resp.StatusCode)
+		}
+		if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/javascript") {
+			t.Error("content type was wrong:", ct)
+		}
+	})
+
+	t.Run("Events", func(t *testing.T) {
+		resp, err := http.Get(server.URL + ReloadEventsPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Error("content type was wrong:", ct)
+		}
+
+		// Wait for the handler to subscribe before emitting
+		for i := 0; ; i++ {
+			w.mut.Lock()
+			n := len(w.subscribers)
+			w.mut.Unlock()
+			if n != 0 {
+				break
+			}
+			if i == 100 {
+				t.Fatal("handler never subscribed")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		w.emit(Event{
+			Type: "css",
+			Results: []CompileResult{
+				{Type: "css", Asset: "css/main.css", Output: "/assets/css/main-abc.css"},
+			},
+		})
+
+		want := `data: {"type":"css","asset":"css/main.css","url":"/assets/css/main-abc.css"}`
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, "data:") {
+				if line != want {
+					t.Errorf("data was wrong\nwant: %s\ngot: %s", want, line)
+				}
+				return
+			}
+		}
+
+		t.Error("stream ended without data:", scanner.Err())
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/assets/__pipedream/nothing")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusNotFound {
+			t.Error("wanted 404, got:", resp.StatusCode)
+		}
+	})
+}
+
+func TestReloadURLServed(t *testing.T) {
+	t.Parallel()
+
+	in := filepath.Join(testTmp, "reload_served")
+	inFile := filepath.Join(in, "css", "main.css")
+
+	if err := os.MkdirAll(filepath.Dir(inFile), 0775); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(inFile, []byte("body { color: red; }"), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	var p Pipedream
+	p.In = in
+	p.Out = filepath.Join(testTmp, "reload_served_out")
+	p.CDNURL = "https://cdn.example.com"
+	p.NoCompress = true
+	p.CSS.Minifier = Command{
+		Cmd:    "sh",
+		Args:   []string{"-c", `printf '/* min */'; cat "$0"`, "$infile"},
+		Stdout: true,
+	}
+
+	// Set up like serve --dev: the watcher only notifies and the dynamic
+	// handler compiles on request
+	w := p.Watcher(nil)
+	w.Debounce = 10 * time.Millisecond
+	w.NotifyOnly = true
+	events, unsubscribe := w.Subscribe()
+	defer unsubscribe()
+
+	handler := p.DynamicHandler(nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- w.Watch(ctx)
+	}()
+
+	var event Event
+	timeout := time.After(5 * time.Second)
+	tick := time.NewTicker(50 * time.Millisecond)
+	defer tick.Stop()
+
+WaitEvent:
+	for i := 0; ; i++ {
+		select {
+		case event = <-events:
+			break WaitEvent
+		case <-tick.C:
+			contents := fmt.Sprintf("body { color: #%06d; }", i)
+			if err := ioutil.WriteFile(inFile, []byte(contents), 0664); err != nil {
+				t.Fatal(err)
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for event")
+		}
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(p.Out, "assets", "manifest.json")); !os.IsNotExist(err) {
+		t.Error("the watcher should not have compiled anything")
+	}
+
+	msgs := w.ReloadHandler().(ReloadHandler).reloadMessages(event)
+	if len(msgs) != 1 || msgs[0].URL != "/assets/css/main.css" {
+		t.Fatalf("wanted one message for the unhashed url, got: %#v", msgs)
+	}
+
+	r := httptest.NewRequest("GET", msgs[0].URL, nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("reload url %s was not served: %d", msgs[0].URL, rec.Code)
+	}
+
+	// The file may have been written again since so only check that it
+	// was compiled
+	if !strings.HasPrefix(rec.Body.String(), "/* min */body { color: #") {
+		t.Errorf("served the wrong file: %s", rec.Body.String())
+	}
+}
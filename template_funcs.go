@@ -1,6 +1,29 @@
 package pipedream
 
-import "fmt"
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Policies for assets that are requested but not in the manifest
+const (
+	// MissingAssetPanic panics, this is the default
+	MissingAssetPanic = "panic"
+	// MissingAssetFallback logs the missing asset and uses its unhashed path
+	MissingAssetFallback = "fallback"
+	// MissingAssetError returns an error from the FuncMap helpers so template
+	// execution fails, the *Path and *Tag methods panic with the error
+	// since they cannot return one.
+	MissingAssetError = "error"
+)
+
+// ErrMissingAsset is the cause of errors for assets that are not in the
+// manifest
+var ErrMissingAsset = errors.New("asset was not in manifest, did you remember to precompile assets?")
 
 // JSPath returns the path for a given js asset.
 func (p Pipedream) JSPath(file string) string {
@@ -32,17 +55,224 @@ func (p Pipedream) FontPath(file string) string {
 	return p.lookupPath(typeFonts, file)
 }
 
+// AssetPath returns the path for an asset of any type. The error's cause is
+// ErrMissingAsset if it's not in the manifest, MissingAsset is not used.
+func (p Pipedream) AssetPath(typ, file string) (string, error) {
+	path, _, err := p.findAsset(typ, file)
+	return path, err
+}
+
+// Path returns the path for an asset of any type, including user defined
+// types.
+func (p Pipedream) Path(typ, file string) string {
+	return p.lookupPath(typ, file)
+}
+
 func (p Pipedream) lookupPath(typ, file string) string {
+	path, _ := p.mustLookupAsset(typ, file)
+	return path
+}
+
+// mustLookupAsset is lookupAsset for helpers that cannot return an error
+func (p Pipedream) mustLookupAsset(typ, file string) (string, FileInfo) {
+	path, info, err := p.lookupAsset(typ, file)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	return path, info
+}
+
+// lookupAsset finds an asset, handling missing assets according to
+// p.MissingAsset.
+func (p Pipedream) lookupAsset(typ, file string) (string, FileInfo, error) {
+	path, info, err := p.findAsset(typ, file)
+	if err == nil {
+		return path, info, nil
+	}
+
+	switch p.MissingAsset {
+	case MissingAssetFallback:
+		p.logf("%v, falling back to unhashed path", err)
+		path = fmt.Sprintf("/assets/%s/%s", typ, file)
+		return p.CDNURL + path, p.CurrentManifest().Files[path], nil
+	case MissingAssetError:
+		return "", info, err
+	default:
+		panic(err.Error())
+	}
+}
+
+// findAsset returns the url for an asset and its details from the manifest,
+// the details are empty if the asset is not fingerprinted and not in the
+// manifest.
+func (p Pipedream) findAsset(typ, file string) (string, FileInfo, error) {
+	manifest := p.CurrentManifest()
+
 	if p.NoHash {
-		return fmt.Sprintf("%s/assets/%s/%s", p.CDNURL, typ, file)
+		path := fmt.Sprintf("/assets/%s/%s", typ, file)
+		return p.CDNURL + path, manifest.Files[path], nil
 	}
 
 	key := fmt.Sprintf("%s/%s", typ, file)
-	asset, ok := p.Manifest.Assets[key]
+	asset, ok := manifest.Assets[key]
 
 	if !ok {
-		panic(fmt.Sprintf("asset %s requested but was not in manifest, did you rememeber to precompile assets?", key))
+		return "", FileInfo{}, errors.Wrapf(ErrMissingAsset, "asset %s requested", key)
+	}
+
+	return p.CDNURL + asset, manifest.Files[asset], nil
+}
+
+func (p Pipedream) logf(format string, v ...interface{}) {
+	if p.Log != nil {
+		p.Log.Printf(format, v...)
+	} else {
+		log.Printf(format, v...)
+	}
+}
+
+// FuncMap returns helpers for html/template that render asset paths and
+// tags, they always use p's current configuration and manifest. Tags
+// include the asset's integrity when the manifest has one and are marked
+// crossorigin when served from a CDN.
+//
+//	{{jsTag "app.js"}}
+//	{{cssTag "app.css"}}
+//	{{imgTag "logo.png" "Logo"}}
+//	{{preloadTag "fonts" "roboto.woff2"}}
+//	{{path "wasm" "app.wasm"}}
+func (p *Pipedream) FuncMap() template.FuncMap {
+	path := func(typ string) func(string) (string, error) {
+		return func(file string) (string, error) {
+			path, _, err := p.lookupAsset(typ, file)
+			return path, err
+		}
+	}
+
+	return template.FuncMap{
+		"jsPath":    path(typeJS),
+		"cssPath":   path(typeCSS),
+		"imgPath":   path(typeImg),
+		"videoPath": path(typeVideos),
+		"audioPath": path(typeAudio),
+		"fontPath":  path(typeFonts),
+		"path": func(typ, file string) (string, error) {
+			return path(typ)(file)
+		},
+
+		"jsTag":      func(file string) (template.HTML, error) { return p.jsTag(file) },
+		"cssTag":     func(file string) (template.HTML, error) { return p.cssTag(file) },
+		"imgTag":     func(file, alt string) (template.HTML, error) { return p.imgTag(file, alt) },
+		"preloadTag": func(typ, file string) (template.HTML, error) { return p.preloadTag(typ, file) },
+	}
+}
+
+// JSTag returns a script tag for a given js asset.
+func (p Pipedream) JSTag(file string) template.HTML {
+	return mustTag(p.jsTag(file))
+}
+
+// CSSTag returns a stylesheet link tag for a given css asset.
+func (p Pipedream) CSSTag(file string) template.HTML {
+	return mustTag(p.cssTag(file))
+}
+
+// ImgTag returns an img tag for a given img asset.
+func (p Pipedream) ImgTag(file, alt string) template.HTML {
+	return mustTag(p.imgTag(file, alt))
+}
+
+// PreloadTag returns a preload link tag for an asset of the given type.
+func (p Pipedream) PreloadTag(typ, file string) template.HTML {
+	return mustTag(p.preloadTag(typ, file))
+}
+
+func mustTag(html template.HTML, err error) template.HTML {
+	if err != nil {
+		panic(err.Error())
+	}
+
+	return html
+}
+
+func (p Pipedream) jsTag(file string) (template.HTML, error) {
+	path, info, err := p.lookupAsset(typeJS, file)
+	if err != nil {
+		return "", err
+	}
+
+	return tag("script", true, p.subresourceAttrs([]string{"src", path}, info, false)...), nil
+}
+
+func (p Pipedream) cssTag(file string) (template.HTML, error) {
+	path, info, err := p.lookupAsset(typeCSS, file)
+	if err != nil {
+		return "", err
+	}
+
+	return tag("link", false, p.subresourceAttrs([]string{"rel", "stylesheet", "href", path}, info, false)...), nil
+}
+
+func (p Pipedream) imgTag(file, alt string) (template.HTML, error) {
+	path, _, err := p.lookupAsset(typeImg, file)
+	if err != nil {
+		return "", err
+	}
+
+	return tag("img", false, "src", path, "alt", alt), nil
+}
+
+// preloadAs is the destination of each asset type for preload links
+var preloadAs = map[string]string{
+	typeJS:     "script",
+	typeCSS:    "style",
+	typeImg:    "image",
+	typeAudio:  "audio",
+	typeVideos: "video",
+	typeFonts:  "font",
+}
+
+func (p Pipedream) preloadTag(typ, file string) (template.HTML, error) {
+	path, info, err := p.lookupAsset(typ, file)
+	if err != nil {
+		return "", err
+	}
+
+	attrs := []string{"rel", "preload", "href", path}
+	if as, ok := preloadAs[typ]; ok {
+		attrs = append(attrs, "as", as)
+	}
+
+	// Fonts are always fetched in cors mode so the preload must be too
+	// or the browser will fetch them twice
+	return tag("link", false, p.subresourceAttrs(attrs, info, typ == typeFonts)...), nil
+}
+
+// subresourceAttrs appends integrity and crossorigin attributes to attrs
+func (p Pipedream) subresourceAttrs(attrs []string, info FileInfo, cors bool) []string {
+	if len(info.Integrity) != 0 {
+		attrs = append(attrs, "integrity", info.Integrity)
+	}
+	if cors || len(p.CDNURL) != 0 {
+		attrs = append(attrs, "crossorigin", "anonymous")
+	}
+
+	return attrs
+}
+
+// tag renders an html element from name, value attribute pairs. Values are
+// escaped so the result is safe to use in html/template.
+func tag(name string, close bool, attrs ...string) template.HTML {
+	var b strings.Builder
+	b.WriteString("<" + name)
+	for i := 0; i+1 < len(attrs); i += 2 {
+		fmt.Fprintf(&b, ` %s="%s"`, attrs[i], template.HTMLEscapeString(attrs[i+1]))
+	}
+	b.WriteString(">")
+	if close {
+		b.WriteString("</" + name + ">")
 	}
 
-	return p.CDNURL + asset
+	return template.HTML(b.String())
 }
@@ -1,10 +1,16 @@
 package pipedream
 
 import (
+	"bytes"
+	"html/template"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/pkg/errors"
 )
 
 func TestTemplatePaths(t *testing.T) {
@@ -103,6 +109,143 @@ func TestTemplatePathsFingerprint(t *testing.T) {
 	}
 }
 
+func TestTemplateFuncMap(t *testing.T) {
+	t.Parallel()
+
+	var p Pipedream
+	p.Manifest = newManifest()
+	p.Manifest.Assets["js/app.js"] = "/assets/js/app-abc.js"
+	p.Manifest.Files["/assets/js/app-abc.js"] = FileInfo{Integrity: "sha384-abc"}
+	p.Manifest.Assets["css/app.css"] = "/assets/css/app-def.css"
+	p.Manifest.Files["/assets/css/app-def.css"] = FileInfo{Integrity: "sha384-def"}
+	p.Manifest.Assets["img/logo.png"] = "/assets/img/logo-ghi.png"
+	p.Manifest.Files["/assets/img/logo-ghi.png"] = FileInfo{Integrity: "sha384-ghi"}
+	p.Manifest.Assets["fonts/font.woff2"] = "/assets/fonts/font-jkl.woff2"
+	p.Manifest.Files["/assets/fonts/font-jkl.woff2"] = FileInfo{Integrity: "sha384-jkl"}
+
+	tpl := template.Must(template.New("").Funcs(p.FuncMap()).Parse(
+		`{{jsTag "app.js"}}{{cssTag "app.css"}}{{imgTag "logo.png" .}}{{preloadTag "fonts" "font.woff2"}}{{jsPath "app.js"}}`,
+	))
+
+	tests := []struct {
+		CDNURL string
+		Want   string
+	}{
+		{"", `<script src="/assets/js/app-abc.js" integrity="sha384-abc"></script>` +
+			`<link rel="stylesheet" href="/assets/css/app-def.css" integrity="sha384-def">` +
+			`<img src="/assets/img/logo-ghi.png" alt="&#34;Logo&#34; &amp; co">` +
+			`<link rel="preload" href="/assets/fonts/font-jkl.woff2" as="font" integrity="sha384-jkl" crossorigin="anonymous">` +
+			`/assets/js/app-abc.js`},
+		{"https://cdn.com", `<script src="https://cdn.com/assets/js/app-abc.js" integrity="sha384-abc" crossorigin="anonymous"></script>` +
+			`<link rel="stylesheet" href="https://cdn.com/assets/css/app-def.css" integrity="sha384-def" crossorigin="anonymous">` +
+			`<img src="https://cdn.com/assets/img/logo-ghi.png" alt="&#34;Logo&#34; &amp; co">` +
+			`<link rel="preload" href="https://cdn.com/assets/fonts/font-jkl.woff2" as="font" integrity="sha384-jkl" crossorigin="anonymous">` +
+			`https://cdn.com/assets/js/app-abc.js`},
+	}
+
+	for _, test := range tests {
+		p.CDNURL = test.CDNURL
+
+		b := &bytes.Buffer{}
+		if err := tpl.Execute(b, `"Logo" & co`); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := b.String(); got != test.Want {
+			t.Errorf("output was wrong\nwant: %s\ngot:  %s", test.Want, got)
+		}
+	}
+}
+
+func TestTemplateTagsNoHash(t *testing.T) {
+	t.Parallel()
+
+	var p Pipedream
+	p.NoHash = true
+
+	if got := p.JSTag(`a"b.js`); got != `<script src="/assets/js/a&#34;b.js"></script>` {
+		t.Error("tag was wrong:", got)
+	}
+	if got := p.PreloadTag("css", "app.css"); got != `<link rel="preload" href="/assets/css/app.css" as="style">` {
+		t.Error("tag was wrong:", got)
+	}
+}
+
+func TestAssetPath(t *testing.T) {
+	t.Parallel()
+
+	var p Pipedream
+	p.Manifest = newManifest()
+	p.Manifest.Assets["js/app.js"] = "/assets/js/app-abc.js"
+
+	if got, err := p.AssetPath("js", "app.js"); err != nil || got != "/assets/js/app-abc.js" {
+		t.Error("path was wrong:", got, err)
+	}
+
+	if _, err := p.AssetPath("js", "typo.js"); errors.Cause(err) != ErrMissingAsset {
+		t.Error("expected ErrMissingAsset, got:", err)
+	}
+}
+
+func TestMissingAsset(t *testing.T) {
+	t.Parallel()
+
+	tpl := `{{jsPath "typo.js"}}`
+
+	t.Run("Panic", func(t *testing.T) {
+		var p Pipedream
+
+		defer func() {
+			if r := recover(); r == nil {
+				t.Error("expected a panic")
+			}
+		}()
+		p.JSPath("typo.js")
+	})
+
+	t.Run("Fallback", func(t *testing.T) {
+		var p Pipedream
+		p.CDNURL = "https://cdn.com"
+		p.MissingAsset = MissingAssetFallback
+
+		logged := &bytes.Buffer{}
+		p.Log = log.New(logged, "", 0)
+
+		if got := p.JSPath("typo.js"); got != "https://cdn.com/assets/js/typo.js" {
+			t.Error("path was wrong:", got)
+		}
+		if got := p.JSTag("typo.js"); got != `<script src="https://cdn.com/assets/js/typo.js" crossorigin="anonymous"></script>` {
+			t.Error("tag was wrong:", got)
+		}
+		if !strings.Contains(logged.String(), "js/typo.js") {
+			t.Error("missing asset was not logged:", logged.String())
+		}
+
+		b := &bytes.Buffer{}
+		if err := template.Must(template.New("").Funcs(p.FuncMap()).Parse(tpl)).Execute(b, nil); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != "https://cdn.com/assets/js/typo.js" {
+			t.Error("template output was wrong:", b.String())
+		}
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		var p Pipedream
+		p.MissingAsset = MissingAssetError
+
+		err := template.Must(template.New("").Funcs(p.FuncMap()).Parse(tpl)).Execute(ioutil.Discard, nil)
+		if err == nil || !strings.Contains(err.Error(), "js/typo.js") {
+			t.Error("expected template error, got:", err)
+		}
+
+		tagTpl := `{{preloadTag "css" "typo.css"}}`
+		if err = template.Must(template.New("").Funcs(p.FuncMap()).Parse(tagTpl)).Execute(ioutil.Discard, nil); err == nil {
+			t.Error("expected template error")
+		}
+	})
+}
+
 var testManifest = `
 {
 	"files": {
@@ -2,14 +2,16 @@ package pipedream
 
 import (
 	"bytes"
-	"compress/gzip"
+	"context"
 	"crypto/md5"
+	"encoding/json"
 	"fmt"
-	"hash"
 	"io"
 	"io/ioutil"
+	"mime"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -18,52 +20,119 @@ import (
 	"github.com/pkg/errors"
 )
 
+// transformed describes the result of a transform.
+type transformed struct {
+	Path      string // /home/compiled/assets/js/homepage/app-209320932030293.js
+	Asset     string // js/homepage/app.js
+	Digest    string // 209320932030293
+	Integrity string // sha384-base64
+	Size      uint64
+	MTime     time.Time
+
+	ContentType string   // text/javascript; charset=utf-8
+	Encodings   []string // [br, gzip]
+}
+
 // transform takes a type of file (subfolder of assets directory: js, css, etc)
-// and a full path to the file to transform and returns the full path to the
-// transformed file.
-func (p Pipedream) transform(typ, file string) (string, error) {
+// and a full path to the file to transform and returns the details of the
+// transformed files. There is more than one transformed file only when the
+// last compiler in the pipeline writes several files to $outdir. Commands
+// still running when ctx is done are killed.
+func (p Pipedream) transform(ctx context.Context, typ, file string) ([]transformed, error) {
 	fn, err := p.mkFileNaming(typ, file)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
+	work, err := newWorkDir()
+	if err != nil {
+		return nil, err
+	}
+	defer work.remove()
+
 	var out piper = inputFile(fn.AbsPath)
-	out, err = p.runPipeline(typ, fn.Extensions, out)
+	out, err = p.runPipeline(ctx, work, fn, out)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	dir, ok := out.(inputDir)
+	if !ok {
+		result, err := p.writeOutput(fn, out)
+		if err != nil {
+			return nil, err
+		}
+		return []transformed{result}, nil
 	}
 
+	files, err := dir.files()
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]transformed, 0, len(files))
+	for _, f := range files {
+		rel, err := filepath.Rel(string(dir), f)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to find relative path in output directory")
+		}
+
+		result, err := p.writeOutput(fn.sibling(rel), inputFile(f))
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// writeOutput writes the pipeline's output to its final (possibly
+// fingerprinted) destination described by fn.
+func (p Pipedream) writeOutput(fn fileNaming, out piper) (transformed, error) {
+	var result transformed
+
 	if err := os.MkdirAll(fn.AbsOutPath, 0755); err != nil {
-		return "", errors.Wrap(err, "failed to create output directory")
+		return result, errors.Wrap(err, "failed to create output directory")
 	}
 
-	outputters := make([]io.Writer, 0, 2)
+	outputters := make([]io.Writer, 0, 4)
 	finalOutput, err := os.Create(fn.OutFile)
 	if err != nil {
-		return "", errors.Wrap(err, "failed to create intermediate output file")
+		return result, errors.Wrap(err, "failed to create intermediate output file")
 	}
 	outputters = append(outputters, finalOutput)
 
-	var fingerprint hash.Hash
-	if !p.NoHash {
-		fingerprint = md5.New()
-		outputters = append(outputters, fingerprint)
+	fingerprint, err := p.newFingerprint()
+	if err != nil {
+		return result, err
 	}
+	integrity, err := p.newIntegrity()
+	if err != nil {
+		return result, err
+	}
+	outputters = append(outputters, fingerprint, integrity)
 
-	var compressedOutput io.WriteCloser
-	var compressor io.WriteCloser
-	if !p.NoCompress {
-		compressedOutput, err = os.Create(fn.OutFile + ".gz")
+	size, err := out.Size()
+	if err != nil {
+		return result, err
+	}
+
+	encodings := p.encodingsFor(fn.Type, fn.Extension, size)
+	compressedOutputs := make([]io.WriteCloser, len(encodings))
+	compressors := make([]io.WriteCloser, len(encodings))
+	for i, enc := range encodings {
+		compressedOutputs[i], err = os.Create(fn.OutFile + enc.Extension)
 		if err != nil {
-			return "", errors.Wrap(err, "failed to create intermediate output file")
+			return result, errors.Wrap(err, "failed to create intermediate output file")
 		}
 
-		compressor, err = gzip.NewWriterLevel(compressedOutput, gzip.BestCompression)
+		compressors[i], err = enc.newWriter(compressedOutputs[i])
 		if err != nil {
-			return "", errors.Wrap(err, "failed to create gzip writer")
+			return result, errors.Wrapf(err, "failed to create %s writer", enc.Name)
 		}
 
-		outputters = append(outputters, compressor)
+		outputters = append(outputters, compressors[i])
 	}
 
 	writer := io.MultiWriter(outputters...)
@@ -76,50 +145,67 @@ func (p Pipedream) transform(typ, file string) (string, error) {
 	case inputFile:
 		reader, err = os.Open(string(o))
 		if err != nil {
-			return "", errors.Wrap(err, "failed to open pipeline's source file")
+			return result, errors.Wrap(err, "failed to open pipeline's source file")
 		}
 	default:
 		panic("unreachable code")
 	}
 
 	if _, err = io.Copy(writer, reader); err != nil {
-		return "", errors.Wrap(err, "failed to write to multiwriter")
+		return result, errors.Wrap(err, "failed to write to multiwriter")
 	}
 
 	if err = reader.Close(); err != nil {
-		return "", errors.Wrap(err, "failed to close the reader")
+		return result, errors.Wrap(err, "failed to close the reader")
 	}
 
 	if err = finalOutput.Close(); err != nil {
-		return "", errors.Wrap(err, "failed to close final output")
+		return result, errors.Wrap(err, "failed to close final output")
 	}
 
+	digest := fmt.Sprintf("%x", fingerprint.Sum(nil))
+
 	var fileName string
 	if !p.NoHash {
-		fileName = fmt.Sprintf("%s-%x.%s", fn.Filename, fingerprint.Sum(nil), fn.Extension)
+		fileName = fmt.Sprintf("%s-%s.%s", fn.Filename, digest, fn.Extension)
 	} else {
 		fileName = fmt.Sprintf("%s.%s", fn.Filename, fn.Extension)
 	}
 	fileName = filepath.Join(fn.AbsOutPath, fileName)
 
-	if !p.NoCompress {
-		if err = compressor.Close(); err != nil {
-			return "", errors.Wrap(err, "failed to flush compressor")
+	for i, enc := range encodings {
+		if err = compressors[i].Close(); err != nil {
+			return result, errors.Wrapf(err, "failed to flush %s compressor", enc.Name)
 		}
-		if err = compressedOutput.Close(); err != nil {
-			return "", errors.Wrap(err, "failed to close compressed output")
+		if err = compressedOutputs[i].Close(); err != nil {
+			return result, errors.Wrapf(err, "failed to close %s output", enc.Name)
 		}
 
-		if err = os.Rename(fn.OutFile+".gz", fileName+".gz"); err != nil {
-			return "", errors.Wrap(err, "failed to rename gzip'd output to final destination")
+		if err = os.Rename(fn.OutFile+enc.Extension, fileName+enc.Extension); err != nil {
+			return result, errors.Wrapf(err, "failed to rename %s output to final destination", enc.Name)
 		}
+
+		result.Encodings = append(result.Encodings, enc.Name)
 	}
 
 	if err = os.Rename(fn.OutFile, fileName); err != nil {
-		return "", errors.Wrap(err, "failed to rename to final destination")
+		return result, errors.Wrap(err, "failed to rename to final destination")
+	}
+
+	stat, err := os.Stat(fileName)
+	if err != nil {
+		return result, errors.Wrap(err, "failed to stat final destination")
 	}
 
-	return fileName, nil
+	result.Path = fileName
+	result.Asset = fn.Asset
+	result.Digest = digest
+	result.Integrity = p.integrity(integrity)
+	result.Size = uint64(size)
+	result.ContentType = mime.TypeByExtension("." + fn.Extension)
+	result.MTime = stat.ModTime()
+
+	return result, nil
 }
 
 // fileNaming defines the file naming for the transform.
@@ -128,16 +214,19 @@ func (p Pipedream) transform(typ, file string) (string, error) {
 // inPath: /home/assets
 // outPath: /home/compiled/assets
 type fileNaming struct {
+	Type       string   // js
 	AbsPath    string   // /home/assets/js/homepage/app.js.ts.erb
 	AbsOutPath string   // /home/compiled/assets/js/homepage
 	Filename   string   // app
 	Extension  string   // js
 	Extensions []string // [ts, erb]
 	OutFile    string   // /home/compiled/assets/js/homepage/app-209320932030293.js
+	Asset      string   // js/homepage/app.js
 }
 
 func (p Pipedream) mkFileNaming(typ, absPath string) (fileNaming, error) {
 	fn := fileNaming{}
+	fn.Type = typ
 	fn.AbsPath = absPath
 
 	filename := filepath.Base(absPath)
@@ -154,6 +243,10 @@ func (p Pipedream) mkFileNaming(typ, absPath string) (fileNaming, error) {
 		}
 	}
 
+	if pos < 0 {
+		return fn, errors.Errorf("file has no extension left after its compiler extensions: %s", absPath)
+	}
+
 	fn.Extension = fragments[pos]
 	fn.Extensions = fragments[pos+1:]
 	fn.Filename = strings.Join(fragments[:pos], ".")
@@ -165,6 +258,7 @@ func (p Pipedream) mkFileNaming(typ, absPath string) (fileNaming, error) {
 	}
 
 	fn.AbsOutPath = filepath.Join(p.Out, "assets", typ, filepath.Dir(relpath))
+	fn.Asset = path.Join(typ, filepath.ToSlash(filepath.Dir(relpath)), fn.Filename+"."+fn.Extension)
 
 	randChunk := strconv.FormatInt(time.Now().UnixNano(), 10)
 
@@ -174,76 +268,259 @@ func (p Pipedream) mkFileNaming(typ, absPath string) (fileNaming, error) {
 	return fn, nil
 }
 
-func (p Pipedream) runPipeline(typ string, exts []string, out piper) (piper, error) {
+// sibling returns the file naming for another file produced by the same
+// transform, rel is its path relative to the command's $outdir.
+func (fn fileNaming) sibling(rel string) fileNaming {
+	sib := fn
+
+	name := filepath.Base(rel)
+	ext := filepath.Ext(name)
+
+	sib.Filename = strings.TrimSuffix(name, ext)
+	sib.Extension = strings.TrimPrefix(ext, ".")
+	sib.Extensions = nil
+	sib.AbsOutPath = filepath.Join(fn.AbsOutPath, filepath.Dir(rel))
+	sib.Asset = path.Join(path.Dir(fn.Asset), filepath.ToSlash(rel))
+
+	randChunk := strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	outFileName := fmt.Sprintf("%s-%s.%s", sib.Filename, randChunk, sib.Extension)
+	sib.OutFile = filepath.Join(sib.AbsOutPath, outFileName)
+
+	return sib
+}
+
+// stage is what a transformer needs to know about the file it's given
+type stage struct {
+	typ  string
+	work workDir
+
+	// inName is the name of the file given to the stage and outName the
+	// name of the file it produces, eg. app.js.ts and app.js. Commands are
+	// given files with these names so tools can pick loaders by extension.
+	inName  string
+	outName string
+}
+
+func (p Pipedream) runPipeline(ctx context.Context, work workDir, fn fileNaming, out piper) (piper, error) {
 	var err error
 
-	var pipeline []transformer
+	name := fn.Filename + "." + fn.Extension
 	if !p.NoCompile {
-		for i := len(exts) - 1; i >= 0; i-- {
-			pipeline = append(pipeline, p.compiler(typ, exts[i]))
+		for i := len(fn.Extensions) - 1; i >= 0; i-- {
+			t := p.compiler(fn.Type, fn.Extensions[i])
+			if t == nil {
+				continue
+			}
+
+			if _, ok := out.(inputDir); ok {
+				return nil, errors.Errorf("compiler for %s cannot run after a compiler that wrote several files", fn.Extensions[i])
+			}
+
+			s := stage{
+				typ:     fn.Type,
+				work:    work,
+				inName:  strings.Join(append([]string{name}, fn.Extensions[:i+1]...), "."),
+				outName: strings.Join(append([]string{name}, fn.Extensions[:i]...), "."),
+			}
+
+			if out, err = t(ctx, s, out); err != nil {
+				return nil, errors.Wrap(err, "failed to execute pipeline")
+			}
 		}
 	}
 
-	if !p.NoMinify {
-		pipeline = append(pipeline, p.minifier(typ))
+	if p.NoMinify {
+		return out, nil
+	}
+
+	if dir, ok := out.(inputDir); ok {
+		return p.minifyDir(ctx, work, fn, dir)
+	}
+
+	t := p.minifier(fn.Type, fn.Extension)
+	if t == nil {
+		return out, nil
+	}
+
+	s := stage{typ: fn.Type, work: work, inName: name, outName: name}
+	if out, err = t(ctx, s, out); err != nil {
+		return nil, errors.Wrap(err, "failed to execute pipeline")
+	}
+
+	return out, nil
+}
+
+// minifyDir minifies each file of a multi-file output into a new folder in
+// work. The type's minifier is only used for files with the same extension
+// as the source, other files like source maps are copied as they are unless
+// there's a minifier for their extension in Minifiers.
+func (p Pipedream) minifyDir(ctx context.Context, work workDir, fn fileNaming, dir inputDir) (piper, error) {
+	files, err := dir.files()
+	if err != nil {
+		return nil, err
+	}
+
+	outDir, err := work.mkdir()
+	if err != nil {
+		return nil, err
 	}
 
-	for _, t := range pipeline {
-		out, err = t(typ, out)
+	exes, _ := p.exes(fn.Type)
+
+	for _, file := range files {
+		rel, err := filepath.Rel(string(dir), file)
 		if err != nil {
-			return nil, errors.Wrap(err, "failed to execute pipeline")
+			return nil, errors.Wrap(err, "failed to find relative path in output directory")
+		}
+
+		var out piper = inputFile(file)
+
+		ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(file), "."))
+		if _, ok := exes.Minifiers[ext]; ok || ext == strings.ToLower(fn.Extension) {
+			if t := p.minifier(fn.Type, ext); t != nil {
+				name := filepath.Base(file)
+				s := stage{typ: fn.Type, work: work, inName: name, outName: name}
+				if out, err = t(ctx, s, out); err != nil {
+					return nil, errors.Wrapf(err, "failed to minify %s", rel)
+				}
+			}
+		}
+
+		if err = copyPiper(filepath.Join(outDir, rel), out); err != nil {
+			return nil, err
 		}
 	}
 
-	return out, nil
+	return inputDir(outDir), nil
 }
 
-type transformer func(typ string, in piper) (piper, error)
+// copyPiper writes the contents of in to the file dst
+func copyPiper(dst string, in piper) error {
+	r, err := in.ToPipe()
+	if err != nil {
+		return err
+	}
 
-func (p Pipedream) compiler(typ string, extension string) transformer {
-	var compiler Command
-	var ok bool
-	switch typ {
-	case "js":
-		compiler, ok = p.JS.Compilers[extension]
-	case "css":
-		compiler, ok = p.CSS.Compilers[extension]
-	case "audio":
-		compiler, ok = p.Audio.Compilers[extension]
-	case "videos":
-		compiler, ok = p.Videos.Compilers[extension]
-	case "fonts":
-		compiler, ok = p.Fonts.Compilers[extension]
-	case "img":
-		compiler, ok = p.Img.Compilers[extension]
+	if err = os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return errors.Wrapf(err, "failed to create directory for %s", dst)
 	}
 
-	if !ok {
-		return nil
+	f, err := os.Create(dst)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create %s", dst)
+	}
+	defer f.Close()
+
+	if _, err = io.Copy(f, r); err != nil {
+		return errors.Wrapf(err, "failed to write %s", dst)
 	}
 
-	return mkTransformer(compiler)
+	return nil
 }
 
-func (p Pipedream) minifier(typ string) transformer {
-	var minifier Command
-	switch typ {
-	case "js":
-		minifier = p.JS.Minifier
-	case "css":
-		minifier = p.CSS.Minifier
+// pipelineDigest fingerprints the configuration the pipeline for a file
+// of typ compiled to ext through exts is built from.
+func (p Pipedream) pipelineDigest(typ, ext string, exts []string) (string, error) {
+	exes, _ := p.exes(typ)
+
+	config := struct {
+		Compilers  []Command
+		Minifier   Command
+		Minifiers  map[string]Command
+		NoCompile  bool
+		NoMinify   bool
+		NoHash     bool
+		NoCompress bool
+		Brotli     bool
+		Zstd       bool
+
+		CompressMinSize     int
+		TypeCompressMinSize int
+		Compressible        []string
+
+		FingerprintHash string
+		IntegrityHash   string
+	}{
+		Minifier:   exes.minifier(ext),
+		Minifiers:  exes.Minifiers,
+		NoCompile:  p.NoCompile,
+		NoMinify:   p.NoMinify,
+		NoHash:     p.NoHash,
+		NoCompress: p.NoCompress,
+		Brotli:     p.Brotli,
+		Zstd:       p.Zstd,
+
+		CompressMinSize:     p.CompressMinSize,
+		TypeCompressMinSize: exes.CompressMinSize,
+		Compressible:        p.Compressible,
+
+		FingerprintHash: p.fingerprintHash(),
+		IntegrityHash:   p.integrityHash(),
+	}
+
+	for _, ext := range exts {
+		config.Compilers = append(config.Compilers, exes.Compilers[ext])
 	}
 
-	if len(minifier.Cmd) == 0 {
+	b, err := json.Marshal(config)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to marshal pipeline config")
+	}
+
+	return fmt.Sprintf("%x", md5.Sum(b)), nil
+}
+
+type transformer func(ctx context.Context, s stage, in piper) (piper, error)
+
+func (p Pipedream) compiler(typ string, extension string) transformer {
+	exes, _ := p.exes(typ)
+	compiler, ok := exes.Compilers[extension]
+	if !ok {
+		return nil
+	}
+
+	return mkTransformer(compiler, p.commandDirs(typ))
+}
+
+func (p Pipedream) minifier(typ, ext string) transformer {
+	exes, _ := p.exes(typ)
+	minifier := exes.minifier(ext)
+	if minifier.isZero() {
 		return nil
 	}
 
-	return mkTransformer(minifier)
+	return mkTransformer(minifier, p.commandDirs(typ))
 }
 
-func mkTransformer(c Command) transformer {
-	return func(typ string, in piper) (piper, error) {
-		out, err := runCmd(in, c)
+// commandDirs are the folders a Command's dir can refer to
+type commandDirs struct {
+	In   string // $in
+	Out  string // $out
+	Type string // $typedir
+}
+
+func (p Pipedream) commandDirs(typ string) commandDirs {
+	return commandDirs{
+		In:   p.In,
+		Out:  p.Out,
+		Type: filepath.Join(p.In, typ),
+	}
+}
+
+func mkTransformer(c Command, dirs commandDirs) transformer {
+	return func(ctx context.Context, s stage, in piper) (piper, error) {
+		if c.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, time.Duration(c.Timeout))
+			defer cancel()
+		}
+
+		if len(c.Transformer) != 0 || len(c.Builtin) != 0 {
+			return runTransformer(ctx, s.typ, in, c)
+		}
+
+		out, err := runCmd(ctx, s, in, c, dirs)
 		if err != nil {
 			return nil, err
 		}
@@ -252,7 +529,7 @@ func mkTransformer(c Command) transformer {
 	}
 }
 
-func runCmd(in piper, c Command, cmdDir string) (piper, error) {
+func runCmd(ctx context.Context, s stage, in piper, c Command, dirs commandDirs) (piper, error) {
 	var err error
 	var out piper
 	var srcFile, dstFile, inDir, outDir string
@@ -261,27 +538,45 @@ func runCmd(in piper, c Command, cmdDir string) (piper, error) {
 	for i := 0; i < len(args); i++ {
 		switch args[i] {
 		case "$infile":
-			srcFile, err = in.ToFile()
+			srcFile, err = in.ToFile(s.work, s.inName)
 			if err != nil {
 				return nil, err
 			}
 			args[i] = srcFile
 		case "$outfile":
-			dstFile = randomTmpFileName()
+			dstFile, err = s.work.file(s.outName)
+			if err != nil {
+				return nil, err
+			}
 			args[i] = dstFile
 		case "$indir":
+			inDir, err = in.ToDir(s.work, s.inName)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = inDir
 		case "$outdir":
+			outDir, err = s.work.mkdir()
+			if err != nil {
+				return nil, err
+			}
+			args[i] = outDir
 		}
 	}
 
-	cmd := exec.Command(c.Cmd, args...)
+	cmd := exec.CommandContext(ctx, c.Cmd, args...)
+	killProcessGroup(cmd)
 
-	if srcFile != "" {
+	switch {
+	case c.Dir != "":
+		cmd.Dir = c.expandDir(dirs)
+	case srcFile != "":
 		cmd.Dir = filepath.Dir(srcFile)
-	} else {
+	default:
 		// input assets/typ folder
-		cmd.Dir(cmdDir)
+		cmd.Dir = dirs.Type
 	}
+	cmd.Env = c.environ()
 
 	if c.Stdin {
 		reader, err := in.ToPipe()
@@ -297,6 +592,11 @@ func runCmd(in piper, c Command, cmdDir string) (piper, error) {
 	cmd.Stderr = stderr
 
 	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			err = errors.Errorf("timed out after %s", time.Duration(c.Timeout))
+		} else if ctx.Err() != nil {
+			err = ctx.Err()
+		}
 		return nil, errors.Wrapf(err, "cmd: %s args: %v\nstderr: %s\nstdout: %s\n",
 			c.Cmd,
 			args,
@@ -305,24 +605,45 @@ func runCmd(in piper, c Command, cmdDir string) (piper, error) {
 		)
 	}
 
-	if c.Stdout {
+	switch {
+	case c.Stdout:
 		out = (*inputBuffer)(stdout)
-	} else {
+	case outDir != "":
+		out, err = collectDir(outDir)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cmd: %s args: %v", c.Cmd, args)
+		}
+	default:
 		out = inputFile(dstFile)
 	}
 	return out, nil
 }
 
-func randomTmpFileName() string {
-	return filepath.Join(
-		os.TempDir(),
-		"pipedream"+strconv.FormatInt(time.Now().UnixNano(), 10),
-	)
+// collectDir turns the files a command wrote to dir into a piper. A single
+// file is treated like $outfile, several become a multi-file output.
+func collectDir(dir string) (piper, error) {
+	files, err := inputDir(dir).files()
+	if err != nil {
+		return nil, err
+	}
+
+	switch len(files) {
+	case 0:
+		return nil, errors.Errorf("no files were written to $outdir %s", dir)
+	case 1:
+		return inputFile(files[0]), nil
+	default:
+		return inputDir(dir), nil
+	}
 }
 
+// piper is the output of one stage of a pipeline and the input of the next.
+// ToFile and ToDir write any files they need to into work, named name.
 type piper interface {
 	ToPipe() (io.Reader, error)
-	ToFile() (string, error)
+	ToFile(work workDir, name string) (string, error)
+	ToDir(work workDir, name string) (string, error)
+	Size() (int64, error)
 }
 
 type inputFile string
@@ -336,33 +657,152 @@ func (i inputFile) ToPipe() (io.Reader, error) {
 	return bytes.NewReader(b), nil
 }
 
-func (i inputFile) ToFile() (string, error) {
+func (i inputFile) ToFile(work workDir, name string) (string, error) {
 	return string(i), nil
 }
 
+func (i inputFile) Size() (int64, error) {
+	stat, err := os.Stat(string(i))
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to stat inputfile")
+	}
+
+	return stat.Size(), nil
+}
+
+func (i inputFile) ToDir(work workDir, name string) (string, error) {
+	src, err := os.Open(string(i))
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to open inputfile for $indir")
+	}
+	defer src.Close()
+
+	return work.writeDir(name, src)
+}
+
 type inputBuffer bytes.Buffer
 
 func (i *inputBuffer) ToPipe() (io.Reader, error) {
 	return (*bytes.Buffer)(i), nil
 }
 
-func (i *inputBuffer) ToFile() (string, error) {
+func (i *inputBuffer) ToFile(work workDir, name string) (string, error) {
 	buf := (*bytes.Buffer)(i)
-	return writeDstFile(buf)
+	return work.writeFile(name, buf)
+}
+
+func (i *inputBuffer) Size() (int64, error) {
+	return int64((*bytes.Buffer)(i).Len()), nil
 }
 
-func writeDstFile(src io.Reader) (string, error) {
-	dst, err := ioutil.TempFile("", "pipedream")
+func (i *inputBuffer) ToDir(work workDir, name string) (string, error) {
+	buf := (*bytes.Buffer)(i)
+	return work.writeDir(name, buf)
+}
+
+// inputDir is a directory holding several output files of a command
+type inputDir string
+
+func (i inputDir) ToPipe() (io.Reader, error) {
+	return nil, errors.Errorf("multi-file output in %s cannot be piped", string(i))
+}
+
+func (i inputDir) ToFile(work workDir, name string) (string, error) {
+	return "", errors.Errorf("multi-file output in %s cannot be used as $infile", string(i))
+}
+
+func (i inputDir) Size() (int64, error) {
+	return 0, errors.Errorf("multi-file output in %s has no single size", string(i))
+}
+
+func (i inputDir) ToDir(work workDir, name string) (string, error) {
+	return string(i), nil
+}
+
+// files returns every file in the directory recursively
+func (i inputDir) files() ([]string, error) {
+	var files []string
+	err := filepath.Walk(string(i), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, path)
+		}
+		return nil
+	})
 	if err != nil {
-		return "", errors.Wrapf(err, "failed to open temp file for writeDst")
+		return nil, errors.Wrapf(err, "failed to list files in %s", string(i))
 	}
-	defer dst.Close()
 
-	dstFile := dst.Name()
+	return files, nil
+}
+
+// workDir is a temporary folder holding the intermediate files of a single
+// transform, it's removed once the outputs have been written.
+type workDir string
+
+func newWorkDir() (workDir, error) {
+	dir, err := ioutil.TempDir("", "pipedream")
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create temp dir for pipeline")
+	}
+
+	return workDir(dir), nil
+}
+
+func (w workDir) remove() {
+	_ = os.RemoveAll(string(w))
+}
+
+// mkdir creates a new empty folder in w
+func (w workDir) mkdir() (string, error) {
+	dir, err := ioutil.TempDir(string(w), "")
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to create temp dir in %s", string(w))
+	}
 
-	_, err = io.Copy(dst, src)
+	return dir, nil
+}
+
+// file returns the path of a file called name in a new folder in w
+func (w workDir) file(name string) (string, error) {
+	dir, err := w.mkdir()
 	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, name), nil
+}
+
+// writeFile copies src to a file called name in a new folder in w and
+// returns its path
+func (w workDir) writeFile(name string, src io.Reader) (string, error) {
+	dstFile, err := w.file(name)
+	if err != nil {
+		return "", err
+	}
+
+	dst, err := os.Create(dstFile)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to create temp file %s", dstFile)
+	}
+	defer dst.Close()
+
+	if _, err = io.Copy(dst, src); err != nil {
 		return "", errors.Wrapf(err, "failed to copy to dstFile %s", dstFile)
 	}
+
 	return dstFile, nil
 }
+
+// writeDir copies src to a file called name in a new folder in w and
+// returns the folder
+func (w workDir) writeDir(name string, src io.Reader) (string, error) {
+	dstFile, err := w.writeFile(name, src)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Dir(dstFile), nil
+}
@@ -2,12 +2,24 @@ package pipedream
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"strings"
 	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
 )
 
 var testTransformFile = `
@@ -18,6 +30,14 @@ var testTransformFileGZ = `
 dreaming of compressed pipes
 `
 
+var testTransformFileBR = `
+dreaming of brotli pipes
+`
+
+var testTransformFileZST = `
+dreaming of zstandard pipes
+`
+
 func TestTransform(t *testing.T) {
 	t.Parallel()
 
@@ -56,15 +76,15 @@ func TestTransform(t *testing.T) {
 		Stdout: true,
 	}
 
-	out, err := p.transform("js", inFile)
+	out, err := p.transform(context.Background(), "js", inFile)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !outFileRgx.MatchString(out) {
-		t.Errorf("output file path did not match regexp:\n%s\n%s", outFileRgx.String(), out)
+	if !outFileRgx.MatchString(out[0].Path) {
+		t.Errorf("output file path did not match regexp:\n%s\n%s", outFileRgx.String(), out[0].Path)
 	}
 
-	b, err := ioutil.ReadFile(out)
+	b, err := ioutil.ReadFile(out[0].Path)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -85,6 +105,7 @@ func TestMkFileNaming(t *testing.T) {
 	filename := "file.thing"
 	extension := "css"
 	extensions := []string{"scss", "erb"}
+	asset := "css/my.things/file.thing.css"
 	outfile := regexp.MustCompile(`^(?i)/out.stuff/assets/css/my.things/file\.thing-[0-9]+\.css$`)
 
 	p := Pipedream{In: inPath, Out: outPath}
@@ -122,9 +143,17 @@ func TestMkFileNaming(t *testing.T) {
 		t.Errorf("OutFile mismatch, got: %s", r.OutFile)
 	}
 
+	if r.Asset != asset {
+		t.Errorf("Asset mismatch\nwant: %s\ngot: %s", asset, r.Asset)
+	}
+
 	if !reflect.DeepEqual(extensions, r.Extensions) {
 		t.Errorf("Extensions mismatch\nwant: %v\ngot: %v", extensions, r.Extensions)
 	}
+
+	if _, err = p.mkFileNaming(typ, "/in_stuff/assets.folder/css/scss.erb"); err == nil {
+		t.Error("expected an error for a file with only compiler extensions")
+	}
 }
 
 func TestTransformMinifyOnly(t *testing.T) {
@@ -156,15 +185,15 @@ func TestTransformMinifyOnly(t *testing.T) {
 		Stdout: true,
 	}
 
-	out, err := p.transform("css", inFile)
+	out, err := p.transform(context.Background(), "css", inFile)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !outFileRgx.MatchString(out) {
-		t.Errorf("output file path did not match regexp:\n%s\n%s", outFileRgx.String(), out)
+	if !outFileRgx.MatchString(out[0].Path) {
+		t.Errorf("output file path did not match regexp:\n%s\n%s", outFileRgx.String(), out[0].Path)
 	}
 
-	b, err := ioutil.ReadFile(out)
+	b, err := ioutil.ReadFile(out[0].Path)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -174,6 +203,517 @@ func TestTransformMinifyOnly(t *testing.T) {
 	}
 }
 
+func TestTransformMinifiers(t *testing.T) {
+	t.Parallel()
+
+	// fake minifies by prefixing its input with the tool's name
+	fake := func(name string) Command {
+		return Command{
+			Cmd:    "sh",
+			Args:   []string{"-c", "printf '" + name + ":'; cat"},
+			Stdin:  true,
+			Stdout: true,
+		}
+	}
+
+	var p Pipedream
+	p.In = filepath.Join(testTmp, "minifiers")
+	p.Out = filepath.Join(testTmp, "minifiers_out")
+	p.NoCompress = true
+
+	p.Img.Minifier = fake("optipng")
+	p.Img.Minifiers = map[string]Command{"svg": fake("svgo")}
+	p.Fonts.Minifier = fake("fonttools")
+	p.Audio.Minifier = fake("sox")
+	p.Videos.Minifier = fake("ffmpeg")
+	p.Types = map[string]Exes{"maps": {Minifier: fake("jq")}}
+
+	tests := []struct {
+		File string
+		Want string
+	}{
+		{"img/logo.png", "optipng:"},
+		{"img/logo.svg", "svgo:"},
+		{"img/LOGO.SVG", "svgo:"},
+		{"fonts/font.woff2", "fonttools:"},
+		{"audio/song.ogg", "sox:"},
+		{"videos/clip.mp4", "ffmpeg:"},
+		{"maps/world.json", "jq:"},
+	}
+
+	for _, test := range tests {
+		inFile := filepath.Join(p.In, filepath.FromSlash(test.File))
+		if err := os.MkdirAll(filepath.Dir(inFile), 0775); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(inFile, []byte(testTransformFile), 0664); err != nil {
+			t.Fatal(err)
+		}
+
+		outs, err := p.transform(context.Background(), filepath.Dir(filepath.FromSlash(test.File)), inFile)
+		if err != nil {
+			t.Errorf("%s: %v", test.File, err)
+			continue
+		}
+
+		b, err := ioutil.ReadFile(outs[0].Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := test.Want + testTransformFile; string(b) != want {
+			t.Errorf("%s: file was wrong:\n%s", test.File, b)
+		}
+	}
+}
+
+func TestTransformDirs(t *testing.T) {
+	t.Parallel()
+
+	inFile := filepath.Join(testTmp, "dirs", "js", "lib", "bundle.js.multi.single")
+	if err := os.MkdirAll(filepath.Dir(inFile), 0775); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(inFile, []byte(testTransformFile), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	var p Pipedream
+	p.In = filepath.Join(testTmp, "dirs")
+	p.Out = filepath.Join(testTmp, "dirs_out")
+	p.NoCompress = true
+	p.NoHash = true
+
+	p.JS.Compilers = map[string]Command{
+		"multi": Command{
+			Cmd:  "sh",
+			Args: []string{"-c", `cp "$0"/* "$1"/bundle.js && mkdir "$1"/maps && cp "$0"/* "$1"/maps/bundle.map`, "$indir", "$outdir"},
+		},
+		"single": Command{
+			Cmd:  "sh",
+			Args: []string{"-c", `cp "$0"/* "$1"/out`, "$indir", "$outdir"},
+		},
+	}
+
+	outs, err := p.transform(context.Background(), "js", inFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(outs) != 2 {
+		t.Fatalf("wanted 2 outputs, got: %#v", outs)
+	}
+
+	want := map[string]string{
+		"js/lib/bundle.js":       filepath.Join(p.Out, "assets", "js", "lib", "bundle.js"),
+		"js/lib/maps/bundle.map": filepath.Join(p.Out, "assets", "js", "lib", "maps", "bundle.map"),
+	}
+
+	for _, out := range outs {
+		path, ok := want[out.Asset]
+		if !ok {
+			t.Errorf("unexpected asset: %s", out.Asset)
+			continue
+		}
+		if out.Path != path {
+			t.Errorf("path mismatch\nwant: %s\ngot: %s", path, out.Path)
+		}
+
+		b, err := ioutil.ReadFile(out.Path)
+		if err != nil {
+			t.Error(err)
+		} else if string(b) != testTransformFile {
+			t.Errorf("file was wrong:\n%s", b)
+		}
+	}
+}
+
+func TestTransformDirsMinified(t *testing.T) {
+	t.Parallel()
+
+	inFile := filepath.Join(testTmp, "dirs_minified", "js", "bundle.js.multi")
+	if err := os.MkdirAll(filepath.Dir(inFile), 0775); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(inFile, []byte(testTransformFile), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	var p Pipedream
+	p.In = filepath.Join(testTmp, "dirs_minified")
+	p.Out = filepath.Join(testTmp, "dirs_minified_out")
+	p.NoCompress = true
+	p.NoHash = true
+
+	p.JS.Compilers = map[string]Command{
+		"multi": Command{
+			Cmd:  "sh",
+			Args: []string{"-c", `cp "$0"/* "$1"/bundle.js && cp "$0"/* "$1"/bundle.map`, "$indir", "$outdir"},
+		},
+	}
+	p.JS.Minifier = Command{
+		Cmd:    "sh",
+		Args:   []string{"-c", `printf 'min:%s' "$(basename "$0")"`, "$infile"},
+		Stdout: true,
+	}
+
+	outs, err := p.transform(context.Background(), "js", inFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"js/bundle.js":  "min:bundle.js",
+		"js/bundle.map": testTransformFile,
+	}
+
+	if len(outs) != len(want) {
+		t.Fatalf("wanted %d outputs, got: %#v", len(want), outs)
+	}
+
+	for _, out := range outs {
+		contents, ok := want[out.Asset]
+		if !ok {
+			t.Errorf("unexpected asset: %s", out.Asset)
+			continue
+		}
+
+		b, err := ioutil.ReadFile(out.Path)
+		if err != nil {
+			t.Error(err)
+		} else if string(b) != contents {
+			t.Errorf("%s was wrong:\n%s", out.Asset, b)
+		}
+	}
+}
+
+func TestInputBufferToDir(t *testing.T) {
+	t.Parallel()
+
+	work := workDir(testTmp)
+
+	buf := (*inputBuffer)(bytes.NewBuffer([]byte(testTransformFile)))
+	dir, err := buf.ToDir(work, "app.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "app.js"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != testTransformFile {
+		t.Error("file output was wrong:\n", string(b))
+	}
+}
+
+func TestTransformCompress(t *testing.T) {
+	t.Parallel()
+
+	inFile := filepath.Join(testTmp, "compress", "css", "main.css")
+	if err := os.MkdirAll(filepath.Dir(inFile), 0775); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(inFile, testCSSFile, 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	var p Pipedream
+	p.In = filepath.Join(testTmp, "compress")
+	p.Out = filepath.Join(testTmp, "compress_out")
+	p.Brotli = true
+	p.Zstd = true
+
+	outs, err := p.transform(context.Background(), "css", inFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readers := map[string]func(io.Reader) (io.Reader, error){
+		".gz":  func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		".br":  func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+		".zst": func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) },
+	}
+
+	if want := []string{"br", "zstd", "gzip"}; !reflect.DeepEqual(outs[0].Encodings, want) {
+		t.Errorf("encodings were wrong\nwant: %v\ngot: %v", want, outs[0].Encodings)
+	}
+
+	for ext, newReader := range readers {
+		f, err := os.Open(outs[0].Path + ext)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		r, err := newReader(f)
+		if err != nil {
+			t.Error(err)
+			f.Close()
+			continue
+		}
+
+		b, err := ioutil.ReadAll(r)
+		f.Close()
+		if err != nil {
+			t.Error(err)
+		} else if !bytes.Equal(b, testCSSFile) {
+			t.Errorf("%s file was wrong:\n%s", ext, b)
+		}
+	}
+}
+
+func TestTransformCompressSkip(t *testing.T) {
+	t.Parallel()
+
+	big := bytes.Repeat([]byte("a"), 200)
+	small := []byte("a")
+
+	tests := []struct {
+		File      string
+		Contents  []byte
+		Configure func(p *Pipedream)
+		Encodings []string
+	}{
+		{"css/big.css", big, nil, []string{"gzip"}},
+		{"img/photo.jpg", big, nil, nil},
+		{"img/photo.png", big, nil, nil},
+		{"img/icon.svg", big, nil, []string{"gzip"}},
+		{"css/tiny.css", small, func(p *Pipedream) { p.CompressMinSize = 100 }, nil},
+		{"css/enough.css", big, func(p *Pipedream) { p.CompressMinSize = 100 }, []string{"gzip"}},
+		{"img/typemin.svg", big, func(p *Pipedream) { p.Img.CompressMinSize = 1000 }, nil},
+		{"css/typemin.css", big, func(p *Pipedream) { p.Img.CompressMinSize = 1000 }, []string{"gzip"}},
+		{"js/app.js", big, func(p *Pipedream) { p.Compressible = []string{"image/*"} }, nil},
+		{"img/allowed.png", big, func(p *Pipedream) { p.Compressible = []string{"image/*"} }, []string{"gzip"}},
+		{"js/exact.js", big, func(p *Pipedream) { p.Compressible = []string{"TEXT/JAVASCRIPT"} }, []string{"gzip"}},
+	}
+
+	for _, test := range tests {
+		var p Pipedream
+		p.In = filepath.Join(testTmp, "compress_skip")
+		p.Out = filepath.Join(testTmp, "compress_skip_out")
+		if test.Configure != nil {
+			test.Configure(&p)
+		}
+
+		inFile := filepath.Join(p.In, filepath.FromSlash(test.File))
+		if err := os.MkdirAll(filepath.Dir(inFile), 0775); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(inFile, test.Contents, 0664); err != nil {
+			t.Fatal(err)
+		}
+
+		outs, err := p.transform(context.Background(), filepath.Dir(filepath.FromSlash(test.File)), inFile)
+		if err != nil {
+			t.Errorf("%s: %v", test.File, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(outs[0].Encodings, test.Encodings) {
+			t.Errorf("%s: encodings were wrong\nwant: %v\ngot: %v", test.File, test.Encodings, outs[0].Encodings)
+		}
+
+		_, err = os.Stat(outs[0].Path + ".gz")
+		if exists := err == nil; exists != (len(test.Encodings) != 0) {
+			t.Errorf("%s: gzip file exists: %t", test.File, exists)
+		}
+	}
+}
+
+func TestTransformHashes(t *testing.T) {
+	t.Parallel()
+
+	contents := []byte("console.log('hashes');\n")
+	sha256Sum := sha256.Sum256(contents)
+	sha384Sum := sha512.Sum384(contents)
+	sha512Sum := sha512.Sum512(contents)
+
+	tests := []struct {
+		Name        string
+		Fingerprint string
+		Integrity   string
+		Digest      string
+		SRI         string
+		Err         bool
+	}{
+		{"default", "", "", fmt.Sprintf("%x", md5.Sum(contents)), "sha384-" + base64.StdEncoding.EncodeToString(sha384Sum[:]), false},
+		{"sha256", "sha256", "sha512", fmt.Sprintf("%x", sha256Sum), "sha512-" + base64.StdEncoding.EncodeToString(sha512Sum[:]), false},
+		{"badfingerprint", "crc32", "", "", "", true},
+		{"badintegrity", "", "md5", "", "", true},
+	}
+
+	for _, test := range tests {
+		var p Pipedream
+		p.In = filepath.Join(testTmp, "hashes")
+		p.Out = filepath.Join(testTmp, "hashes_out")
+		p.NoCompress = true
+		p.FingerprintHash = test.Fingerprint
+		p.IntegrityHash = test.Integrity
+
+		inFile := filepath.Join(p.In, "js", test.Name+".js")
+		if err := os.MkdirAll(filepath.Dir(inFile), 0775); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(inFile, contents, 0664); err != nil {
+			t.Fatal(err)
+		}
+
+		outs, err := p.transform(context.Background(), "js", inFile)
+		if test.Err {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.Name)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: %v", test.Name, err)
+			continue
+		}
+
+		if outs[0].Digest != test.Digest {
+			t.Errorf("%s: digest was wrong\nwant: %s\ngot: %s", test.Name, test.Digest, outs[0].Digest)
+		}
+		if outs[0].Integrity != test.SRI {
+			t.Errorf("%s: integrity was wrong\nwant: %s\ngot: %s", test.Name, test.SRI, outs[0].Integrity)
+		}
+		if want := test.Name + "-" + test.Digest + ".js"; filepath.Base(outs[0].Path) != want {
+			t.Errorf("%s: file name was wrong\nwant: %s\ngot: %s", test.Name, want, filepath.Base(outs[0].Path))
+		}
+	}
+}
+
+func TestTransformCommandEnvDir(t *testing.T) {
+	t.Parallel()
+
+	var p Pipedream
+	p.In = filepath.Join(testTmp, "envdir")
+	p.Out = filepath.Join(testTmp, "envdir_out")
+	p.NoCompress = true
+
+	inFile := filepath.Join(p.In, "js", "nested", "app.js")
+	if err := os.MkdirAll(filepath.Dir(inFile), 0775); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(inFile, []byte("var a = 1;"), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	typeDir, err := filepath.EvalSymlinks(filepath.Join(p.In, "js"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inDir, err := filepath.EvalSymlinks(p.In)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inherit := false
+
+	tests := []struct {
+		Name    string
+		Command Command
+		Want    string
+	}{
+		{"env", Command{Env: map[string]string{"PIPEDREAM_TEST": "production"}, Dir: "$typedir"}, "production:" + typeDir + ":" + os.Getenv("HOME")},
+		{"typedir", Command{Dir: "${typedir}/nested"}, ":" + filepath.Join(typeDir, "nested") + ":" + os.Getenv("HOME")},
+		{"in", Command{Dir: "$in", InheritEnv: &inherit}, ":" + inDir + ":"},
+		{"default", Command{}, ":" + typeDir + ":" + os.Getenv("HOME")},
+	}
+
+	for _, test := range tests {
+		c := test.Command
+		c.Cmd = "sh"
+		c.Args = []string{"-c", `printf '%s:%s:%s' "$PIPEDREAM_TEST" "$(pwd -P)" "$HOME"`}
+		c.Stdout = true
+		p.JS.Minifier = c
+
+		outs, err := p.transform(context.Background(), "js", inFile)
+		if err != nil {
+			t.Errorf("%s: %v", test.Name, err)
+			continue
+		}
+
+		b, err := ioutil.ReadFile(outs[0].Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(b) != test.Want {
+			t.Errorf("%s: output was wrong\nwant: %s\ngot:  %s", test.Name, test.Want, b)
+		}
+	}
+}
+
+func TestTransformWorkDir(t *testing.T) {
+	t.Parallel()
+
+	var p Pipedream
+	p.In = filepath.Join(testTmp, "workdir")
+	p.Out = filepath.Join(testTmp, "workdir_out")
+	p.NoCompress = true
+
+	inFile := filepath.Join(p.In, "js", "app.js.ts")
+	if err := os.MkdirAll(filepath.Dir(inFile), 0775); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(inFile, []byte("var a = 1;"), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	logFile := filepath.Join(testTmp, "workdir_log")
+
+	p.JS.Compilers = map[string]Command{
+		"ts": {
+			Cmd:  "sh",
+			Args: []string{"-c", `ls "$1" >> "$3" && echo "$1" >> "$3" && echo "$2" >> "$3" && cp "$1"/* "$2"`, "sh", "$indir", "$outfile", logFile},
+		},
+	}
+	p.JS.Minifier = Command{
+		Cmd:    "sh",
+		Args:   []string{"-c", `basename "$1" >> "$2" && echo "$1" >> "$2" && cat "$1"`, "sh", "$infile", logFile},
+		Stdout: true,
+	}
+
+	outs, err := p.transform(context.Background(), "js", inFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(outs[0].Path)
+	if err != nil {
+		t.Fatal(err)
+	} else if string(b) != "var a = 1;" {
+		t.Errorf("output was wrong: %s", b)
+	}
+
+	b, err = ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("log was wrong:\n%s", b)
+	}
+
+	if lines[0] != "app.js.ts" {
+		t.Errorf("$indir should contain app.js.ts, got: %s", lines[0])
+	}
+	if filepath.Base(lines[2]) != "app.js" {
+		t.Errorf("$outfile should be named app.js, got: %s", lines[2])
+	}
+	if lines[3] != "app.js" {
+		t.Errorf("$infile should be named app.js, got: %s", lines[3])
+	}
+
+	for _, path := range []string{lines[1], lines[2], lines[4]} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("temporary path was not removed: %s", path)
+		}
+	}
+}
+
 func TestInputFileToPipe(t *testing.T) {
 	t.Parallel()
 
@@ -204,7 +744,7 @@ func TestInputFileToFile(t *testing.T) {
 	}
 
 	in := inputFile(inFile)
-	filename, err := in.ToFile()
+	filename, err := in.ToFile(workDir(testTmp), "app.js")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -227,11 +767,15 @@ func TestInputBufferToFile(t *testing.T) {
 	t.Parallel()
 
 	buf := (*inputBuffer)(bytes.NewBuffer([]byte(testTransformFile)))
-	filename, err := buf.ToFile()
+	filename, err := buf.ToFile(workDir(testTmp), "app.js")
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	if filepath.Base(filename) != "app.js" {
+		t.Error("filename was wrong:", filename)
+	}
+
 	b, err := ioutil.ReadFile(filename)
 	if err != nil {
 		t.Fatal(err)
@@ -0,0 +1,121 @@
+package pipedream
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Transformer is a compiler or minifier that runs in process rather than as
+// an external command. It's referenced by the name it was registered with
+// from the transformer key of a Command:
+//
+//	[js.minifier]
+//	transformer = "uglify"
+type Transformer interface {
+	// Transform reads an asset of typ from in and writes the result to out.
+	// It should return once ctx is done, if it doesn't the pipeline stops
+	// waiting for it and its output is discarded.
+	Transform(ctx context.Context, typ string, in io.Reader, out io.Writer) error
+}
+
+// TransformerFunc adapts a function to a Transformer
+type TransformerFunc func(ctx context.Context, typ string, in io.Reader, out io.Writer) error
+
+// Transform calls fn
+func (fn TransformerFunc) Transform(ctx context.Context, typ string, in io.Reader, out io.Writer) error {
+	return fn(ctx, typ, in, out)
+}
+
+var (
+	transformersMut sync.RWMutex
+	transformers    = make(map[string]Transformer)
+)
+
+// RegisterTransformer makes a Transformer available to pipelines by name.
+// It panics if t is nil or the name is already registered.
+func RegisterTransformer(name string, t Transformer) {
+	transformersMut.Lock()
+	defer transformersMut.Unlock()
+
+	if t == nil {
+		panic("pipedream: RegisterTransformer transformer is nil")
+	}
+	if _, ok := transformers[name]; ok {
+		panic("pipedream: RegisterTransformer called twice for " + name)
+	}
+
+	transformers[name] = t
+}
+
+func lookupTransformer(name string) (Transformer, bool) {
+	transformersMut.RLock()
+	defer transformersMut.RUnlock()
+
+	t, ok := transformers[name]
+	return t, ok
+}
+
+// commandTransformer returns the in process transformer c refers to and a
+// name for it to use in errors.
+func commandTransformer(c Command) (Transformer, string, error) {
+	if len(c.Cmd) != 0 {
+		return nil, "", errors.Errorf("command %s cannot also use a transformer or builtin", c.Cmd)
+	}
+	if len(c.Transformer) != 0 && len(c.Builtin) != 0 {
+		return nil, "", errors.Errorf("transformer %s cannot also use builtin %s", c.Transformer, c.Builtin)
+	}
+
+	if len(c.Builtin) != 0 {
+		t, ok := builtinTransformer(c.Builtin)
+		if !ok {
+			return nil, "", errors.Errorf("no builtin minifier named %s", c.Builtin)
+		}
+		return t, "builtin " + c.Builtin, nil
+	}
+
+	t, ok := lookupTransformer(c.Transformer)
+	if !ok {
+		return nil, "", errors.Errorf("no transformer registered as %s", c.Transformer)
+	}
+
+	return t, "transformer " + c.Transformer, nil
+}
+
+// runTransformer runs in through the in process transformer c refers to
+func runTransformer(ctx context.Context, typ string, in piper, c Command) (piper, error) {
+	t, name, err := commandTransformer(c)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := in.ToPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	out := &bytes.Buffer{}
+	done := make(chan error, 1)
+	go func() {
+		done <- t.Transform(ctx, typ, r, out)
+	}()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, errors.Wrapf(err, "%s timed out after %s", name, time.Duration(c.Timeout))
+		}
+		return nil, errors.Wrapf(err, "%s failed", name)
+	}
+
+	return (*inputBuffer)(out), nil
+}
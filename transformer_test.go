@@ -0,0 +1,132 @@
+package pipedream
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransformerPipeline(t *testing.T) {
+	t.Parallel()
+
+	RegisterTransformer("test-upper", TransformerFunc(func(ctx context.Context, typ string, in io.Reader, out io.Writer) error {
+		b, err := ioutil.ReadAll(in)
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(bytes.ToUpper(b))
+		return err
+	}))
+	RegisterTransformer("test-banner", TransformerFunc(func(ctx context.Context, typ string, in io.Reader, out io.Writer) error {
+		if _, err := io.WriteString(out, "/* "+typ+" */"); err != nil {
+			return err
+		}
+		_, err := io.Copy(out, in)
+		return err
+	}))
+
+	var p Pipedream
+	p.In = filepath.Join(testTmp, "transformers")
+	p.Out = filepath.Join(testTmp, "transformers_out")
+	p.NoCompress = true
+
+	p.JS.Compilers = map[string]Command{
+		"upper": {Transformer: "test-upper"},
+		"tee": {
+			Cmd:   "tee",
+			Args:  []string{"$outfile"},
+			Stdin: true,
+		},
+	}
+	p.JS.Minifier = Command{Transformer: "test-banner"}
+
+	inFile := filepath.Join(p.In, "js", "app.js.upper.tee")
+	if err := os.MkdirAll(filepath.Dir(inFile), 0775); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(inFile, []byte("var a = 1;"), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	outs, err := p.transform(context.Background(), "js", inFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(outs[0].Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != "/* js */VAR A = 1;" {
+		t.Errorf("file was wrong: %s", b)
+	}
+
+	p.JS.Minifier = Command{Transformer: "test-missing"}
+	if _, err = p.transform(context.Background(), "js", inFile); err == nil || !strings.Contains(err.Error(), "test-missing") {
+		t.Error("expected an error for an unregistered transformer, got:", err)
+	}
+
+	p.JS.Minifier = Command{Cmd: "cat", Transformer: "test-banner"}
+	if _, err = p.transform(context.Background(), "js", inFile); err == nil {
+		t.Error("expected an error for a command with a transformer")
+	}
+}
+
+func TestTransformerTimeout(t *testing.T) {
+	t.Parallel()
+
+	// The transformer ignores ctx so the pipeline has to stop waiting
+	release := make(chan struct{})
+	defer close(release)
+	RegisterTransformer("test-hang", TransformerFunc(func(ctx context.Context, typ string, in io.Reader, out io.Writer) error {
+		<-release
+		return nil
+	}))
+
+	var p Pipedream
+	p.In = filepath.Join(testTmp, "transformer_timeout")
+	p.Out = filepath.Join(testTmp, "transformer_timeout_out")
+	p.NoCompress = true
+	p.JS.Minifier = Command{Transformer: "test-hang", Timeout: Duration(50 * time.Millisecond)}
+
+	inFile := filepath.Join(p.In, "js", "app.js")
+	if err := os.MkdirAll(filepath.Dir(inFile), 0775); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(inFile, []byte("var a = 1;"), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, err := p.transform(context.Background(), "js", inFile)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Error("expected a timeout error, got:", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Error("transform was not stopped by the timeout, took:", elapsed)
+	}
+}
+
+func TestRegisterTransformerTwice(t *testing.T) {
+	t.Parallel()
+
+	fn := TransformerFunc(func(ctx context.Context, typ string, in io.Reader, out io.Writer) error {
+		return nil
+	})
+
+	RegisterTransformer("test-twice", fn)
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("expected a panic")
+		}
+	}()
+	RegisterTransformer("test-twice", fn)
+}
@@ -0,0 +1,392 @@
+package pipedream
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+// DefaultDebounce is how long a Watcher waits for filesystem events to
+// settle before recompiling.
+const DefaultDebounce = 100 * time.Millisecond
+
+// Event is emitted by a Watcher each time a source in the input folder has
+// been recompiled or removed.
+type Event struct {
+	Type    string // js
+	Source  string // /home/assets/js/homepage/app.js.ts
+	Removed bool
+	Results []CompileResult
+}
+
+// Watcher recompiles sources in the input folder as they change and keeps
+// the manifest up to date.
+type Watcher struct {
+	*Pipedream
+	log *log.Logger
+
+	// Debounce is how long to wait for events to settle, DefaultDebounce
+	// is used if it's zero.
+	Debounce time.Duration
+
+	// NotifyOnly emits events for changed sources without compiling them
+	// or touching the manifest, for when a DynamicHandler compiles assets
+	// as they're requested. Event results hold each source's unhashed url.
+	NotifyOnly bool
+
+	mut         sync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+// Watcher returns a Watcher object with a logger. From then on the manifest
+// is replaced as sources are recompiled, so it must be read with
+// CurrentManifest rather than p.Manifest.
+func (p *Pipedream) Watcher(log *log.Logger) *Watcher {
+	if p.store == nil {
+		p.store = &manifestStore{manifest: p.Manifest}
+	}
+
+	return &Watcher{
+		Pipedream:   p,
+		log:         log,
+		subscribers: make(map[chan Event]struct{}),
+	}
+}
+
+func (w *Watcher) logf(format string, v ...interface{}) {
+	if w.log != nil {
+		w.log.Printf(format, v...)
+	}
+}
+
+// Subscribe returns a channel that receives every Event emitted by the
+// watcher and a function to unsubscribe. Events are dropped for
+// subscribers that fall more than a few events behind rather than stalling
+// the watcher.
+func (w *Watcher) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, 16)
+
+	w.mut.Lock()
+	w.subscribers[ch] = struct{}{}
+	w.mut.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			w.mut.Lock()
+			delete(w.subscribers, ch)
+			w.mut.Unlock()
+			close(ch)
+		})
+	}
+}
+
+func (w *Watcher) emit(e Event) {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	for ch := range w.subscribers {
+		select {
+		case ch <- e:
+		default:
+			w.logf("dropped event for %s, subscriber is not keeping up", e.Source)
+		}
+	}
+}
+
+// Watch compiles all assets then watches the input folder, recompiling
+// sources as they change until ctx is done. The manifest is replaced and
+// written to disk after each batch of changes. With NotifyOnly nothing is
+// compiled, events are only emitted for the changes.
+func (w *Watcher) Watch(ctx context.Context) error {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrap(err, "failed to create filesystem watcher")
+	}
+	defer fsw.Close()
+
+	if err = w.addDirs(fsw, w.In); err != nil {
+		return err
+	}
+
+	if !w.NotifyOnly {
+		w.initialCompile(ctx)
+	}
+
+	debounce := w.Debounce
+	if debounce == 0 {
+		debounce = DefaultDebounce
+	}
+
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+
+	pending := make(map[string]struct{})
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-fsw.Errors:
+			w.logf("filesystem watcher error: %v", err)
+		case e := <-fsw.Events:
+			if e.Op == fsnotify.Chmod {
+				continue
+			}
+
+			if e.Op&fsnotify.Create != 0 {
+				if info, err := os.Stat(e.Name); err == nil && info.IsDir() {
+					if err := w.addDirs(fsw, e.Name); err != nil {
+						w.logf("failed to watch %s: %v", e.Name, err)
+					}
+				}
+			}
+
+			pending[e.Name] = struct{}{}
+			timer.Reset(debounce)
+		case <-timer.C:
+			if w.NotifyOnly {
+				w.notify(pending)
+			} else {
+				w.recompile(ctx, pending)
+			}
+			pending = make(map[string]struct{})
+		}
+	}
+}
+
+// initialCompile compiles every asset and publishes the manifest
+func (w *Watcher) initialCompile(ctx context.Context) {
+	// The manifest is written even if some files failed so the assets that
+	// did compile are kept when the rest are fixed and recompiled.
+	previous, err := w.previousManifest()
+	if err != nil {
+		w.logf("failed to read manifest: %v", err)
+	}
+
+	manifest, _, err := w.compile(ctx, previous)
+	if err != nil {
+		w.logf("initial compile failed: %v", err)
+	}
+
+	if manifest.Sources == nil {
+		if previous.Sources != nil {
+			manifest = previous
+		} else {
+			manifest = newManifest()
+		}
+	} else if err := w.writeManifest(manifest); err != nil {
+		w.logf("failed to write manifest: %v", err)
+	} else {
+		w.removeStaleOutputs(previous, manifest)
+	}
+	w.setManifest(manifest)
+}
+
+// addDirs watches dir and every folder beneath it
+func (w *Watcher) addDirs(fsw *fsnotify.Watcher, dir string) error {
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			return nil
+		}
+		if path != dir && strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
+
+		return fsw.Add(path)
+	})
+
+	return errors.Wrapf(err, "failed to watch %s", dir)
+}
+
+// recompile compiles every changed path and publishes the new manifest
+func (w *Watcher) recompile(ctx context.Context, paths map[string]struct{}) {
+	previous := w.CurrentManifest()
+	manifest := previous.clone()
+
+	var events []Event
+	for path := range paths {
+		typ, ok := w.sourceType(path)
+		if !ok {
+			continue
+		}
+
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			key, err := filepath.Rel(w.In, path)
+			if err != nil {
+				continue
+			}
+			key = filepath.ToSlash(key)
+
+			removed := false
+			for source := range manifest.Sources {
+				if source == key || strings.HasPrefix(source, key+"/") {
+					manifest.removeSource(source)
+					removed = true
+				}
+			}
+
+			if removed {
+				events = append(events, Event{Type: typ, Source: path, Removed: true})
+			}
+			continue
+		} else if err != nil {
+			w.logf("failed to stat %s: %v", path, err)
+			continue
+		}
+
+		if info.IsDir() {
+			files, err := w.assetFiles(typ)
+			if err != nil {
+				w.logf("failed to list %s: %v", path, err)
+				continue
+			}
+			for _, file := range files {
+				if strings.HasPrefix(file, path+string(os.PathSeparator)) {
+					if e, ok := w.recompileFile(ctx, manifest, typ, file); ok {
+						events = append(events, e)
+					}
+				}
+			}
+			continue
+		}
+
+		if info.Mode().IsRegular() {
+			if e, ok := w.recompileFile(ctx, manifest, typ, path); ok {
+				events = append(events, e)
+			}
+		}
+	}
+
+	if len(events) == 0 {
+		return
+	}
+
+	if err := w.writeManifest(manifest); err != nil {
+		w.logf("failed to write manifest: %v", err)
+		return
+	}
+	w.setManifest(manifest)
+	w.removeStaleOutputs(previous, manifest)
+
+	for _, e := range events {
+		w.emit(e)
+	}
+}
+
+// notify emits an event for every changed source without compiling it
+func (w *Watcher) notify(paths map[string]struct{}) {
+	for path := range paths {
+		typ, ok := w.sourceType(path)
+		if !ok {
+			continue
+		}
+
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			w.emit(Event{Type: typ, Source: path, Removed: true})
+			continue
+		} else if err != nil {
+			w.logf("failed to stat %s: %v", path, err)
+			continue
+		}
+
+		if info.IsDir() {
+			files, err := w.assetFiles(typ)
+			if err != nil {
+				w.logf("failed to list %s: %v", path, err)
+				continue
+			}
+			for _, file := range files {
+				if strings.HasPrefix(file, path+string(os.PathSeparator)) {
+					w.emit(w.changeEvent(typ, file))
+				}
+			}
+			continue
+		}
+
+		if info.Mode().IsRegular() {
+			w.emit(w.changeEvent(typ, path))
+		}
+	}
+}
+
+// changeEvent returns the event for a changed source that hasn't been
+// compiled, its result holds the unhashed url the source is served at.
+func (w *Watcher) changeEvent(typ, file string) Event {
+	result := CompileResult{Type: typ, Source: file}
+
+	fn, err := w.mkFileNaming(typ, file)
+	if err != nil {
+		result.Err = err
+	} else {
+		result.Asset = fn.Asset
+		result.Output = "/assets/" + fn.Asset
+	}
+
+	return Event{Type: typ, Source: file, Results: []CompileResult{result}}
+}
+
+// recompileFile compiles a single file into manifest. The manifest entries
+// for the file are only replaced if it compiled successfully. It returns
+// false if the file's outputs were reused because nothing changed.
+func (w *Watcher) recompileFile(ctx context.Context, manifest Manifest, typ, file string) (Event, bool) {
+	key, source, results := w.compileFile(ctx, manifest, typ, file)
+	manifest.checkDuplicates(key, results)
+
+	failed, changed := false, false
+	for _, r := range results {
+		if r.Err != nil {
+			w.logf("failed to compile %s: %v", file, r.Err)
+			failed = true
+		}
+		if !r.Cached {
+			changed = true
+		}
+	}
+
+	if !failed {
+		manifest.removeSource(key)
+		manifest.addSource(key, source, results)
+	}
+
+	return Event{Type: typ, Source: file, Results: results}, changed
+}
+
+// sourceType returns the asset type of a path in the input folder, paths
+// outside of an asset type's folder or that are hidden are not sources.
+func (p *Pipedream) sourceType(path string) (string, bool) {
+	rel, err := filepath.Rel(p.In, path)
+	if err != nil {
+		return "", false
+	}
+
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if len(parts) < 2 {
+		return "", false
+	}
+
+	for _, part := range parts {
+		if strings.HasPrefix(part, ".") {
+			return "", false
+		}
+	}
+
+	if _, ok := p.exes(parts[0]); !ok {
+		return "", false
+	}
+
+	return parts[0], true
+}
@@ -0,0 +1,295 @@
+package pipedream
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	t.Parallel()
+
+	in := filepath.Join(testTmp, "watch")
+	inFile := filepath.Join(in, "js", "app.js.cat")
+
+	if err := os.MkdirAll(filepath.Dir(inFile), 0775); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(inFile, []byte(testTransformFile), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	var p Pipedream
+	p.In = in
+	p.Out = filepath.Join(testTmp, "watch_out")
+	p.NoCompress = true
+	p.JS.Compilers = map[string]Command{
+		"cat": Command{
+			Cmd:    "cat",
+			Stdin:  true,
+			Stdout: true,
+		},
+	}
+
+	w := p.Watcher(nil)
+	w.Debounce = 10 * time.Millisecond
+	events, unsubscribe := w.Subscribe()
+	defer unsubscribe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- w.Watch(ctx)
+	}()
+
+	// The watcher may not be listening yet so keep changing the file
+	// until an event comes through.
+	var event Event
+	timeout := time.After(5 * time.Second)
+	tick := time.NewTicker(50 * time.Millisecond)
+	defer tick.Stop()
+
+WaitEvent:
+	for i := 0; ; i++ {
+		select {
+		case event = <-events:
+			break WaitEvent
+		case <-tick.C:
+			if err := ioutil.WriteFile(inFile, []byte(fmt.Sprintf("change %d", i)), 0664); err != nil {
+				t.Fatal(err)
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for event")
+		}
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+
+	if event.Source != inFile || event.Type != "js" || event.Removed {
+		t.Errorf("event was wrong: %#v", event)
+	}
+	if len(event.Results) != 1 || event.Results[0].Err != nil || event.Results[0].Cached {
+		t.Fatalf("event results were wrong: %#v", event.Results)
+	}
+
+	var loaded Pipedream
+	loaded.Out = p.Out
+	if err := loaded.LoadManifest(); err != nil {
+		t.Fatal(err)
+	}
+
+	output := loaded.Manifest.Assets["js/app.js"]
+	if output != event.Results[0].Output {
+		t.Errorf("manifest was not updated, wanted %s got %s", event.Results[0].Output, output)
+	}
+
+	// Outputs of earlier compiles are removed as they're replaced
+	files, err := ioutil.ReadDir(filepath.Join(p.Out, "assets", "js"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || "/assets/js/"+files[0].Name() != output {
+		var names []string
+		for _, f := range files {
+			names = append(names, f.Name())
+		}
+		t.Errorf("wanted only %s in the output folder, got: %v", output, names)
+	}
+}
+
+func TestWatchInitialCompileFails(t *testing.T) {
+	t.Parallel()
+
+	in := filepath.Join(testTmp, "watch_fails")
+	for name, contents := range map[string]string{
+		"good.js":  "var good = 1;",
+		"other.js": "var other = 1;",
+		"bad.js":   "broken",
+	} {
+		file := filepath.Join(in, "js", name)
+		if err := os.MkdirAll(filepath.Dir(file), 0775); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(contents), 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+	badFile := filepath.Join(in, "js", "bad.js")
+
+	var p Pipedream
+	p.In = in
+	p.Out = filepath.Join(testTmp, "watch_fails_out")
+	p.NoCompress = true
+	p.JS.Minifier = Command{
+		Cmd:    "sh",
+		Args:   []string{"-c", `grep -q broken "$1" && exit 1; cat "$1"`, "sh", "$infile"},
+		Stdout: true,
+	}
+
+	w := p.Watcher(nil)
+	w.Debounce = 10 * time.Millisecond
+	events, unsubscribe := w.Subscribe()
+	defer unsubscribe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- w.Watch(ctx)
+	}()
+
+	timeout := time.After(5 * time.Second)
+	tick := time.NewTicker(50 * time.Millisecond)
+	defer tick.Stop()
+
+WaitEvent:
+	for i := 0; ; i++ {
+		select {
+		case e := <-events:
+			if e.Source == badFile && len(e.Results) == 1 && e.Results[0].Err == nil {
+				break WaitEvent
+			}
+		case <-tick.C:
+			if err := ioutil.WriteFile(badFile, []byte(fmt.Sprintf("var fixed = %d;", i)), 0664); err != nil {
+				t.Fatal(err)
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for event")
+		}
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+
+	var loaded Pipedream
+	loaded.Out = p.Out
+	if err := loaded.LoadManifest(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, asset := range []string{"js/good.js", "js/other.js", "js/bad.js"} {
+		if _, ok := loaded.Manifest.Assets[asset]; !ok {
+			t.Errorf("manifest is missing %s: %#v", asset, loaded.Manifest.Assets)
+		}
+	}
+}
+
+func TestWatchConcurrentReads(t *testing.T) {
+	t.Parallel()
+
+	in := filepath.Join(testTmp, "watch_reads")
+	inFile := filepath.Join(in, "js", "app.js")
+
+	if err := os.MkdirAll(filepath.Dir(inFile), 0775); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(inFile, []byte(testTransformFile), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	var p Pipedream
+	p.In = in
+	p.Out = filepath.Join(testTmp, "watch_reads_out")
+	p.NoCompress = true
+	p.MissingAsset = MissingAssetError
+
+	w := p.Watcher(nil)
+	w.Debounce = time.Millisecond
+	events, unsubscribe := w.Subscribe()
+	defer unsubscribe()
+
+	handler := p.StaticHandler(nil)
+	jsPath := p.FuncMap()["jsPath"].(func(string) (string, error))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- w.Watch(ctx)
+	}()
+
+	// Read the manifest the way templates and the handler do while the
+	// watcher replaces it, the race detector catches unguarded access.
+	stopReading := make(chan struct{})
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		for {
+			select {
+			case <-stopReading:
+				return
+			default:
+			}
+
+			if path, err := jsPath("app.js"); err == nil {
+				r := httptest.NewRequest("GET", path, nil)
+				handler.ServeHTTP(httptest.NewRecorder(), r)
+			}
+		}
+	}()
+
+	timeout := time.After(5 * time.Second)
+	tick := time.NewTicker(20 * time.Millisecond)
+	defer tick.Stop()
+
+	received := 0
+	for i := 0; received < 3; i++ {
+		select {
+		case <-events:
+			received++
+		case <-tick.C:
+			if err := ioutil.WriteFile(inFile, []byte(fmt.Sprintf("var a = %d;", i)), 0664); err != nil {
+				t.Fatal(err)
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for events")
+		}
+	}
+
+	close(stopReading)
+	<-readerDone
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+
+	if _, err := jsPath("app.js"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSourceType(t *testing.T) {
+	t.Parallel()
+
+	p := Pipedream{In: "/in"}
+
+	tests := []struct {
+		Path string
+		Type string
+		OK   bool
+	}{
+		{"/in/js/app.js", "js", true},
+		{"/in/css/deep/app.css", "css", true},
+		{"/in/js", "", false},
+		{"/in/bad/app.js", "", false},
+		{"/in/js/.app.js.swp", "", false},
+		{"/in/js/.git/app.js", "", false},
+		{"/elsewhere/js/app.js", "", false},
+	}
+
+	for i, test := range tests {
+		typ, ok := p.sourceType(test.Path)
+		if typ != test.Type || ok != test.OK {
+			t.Errorf("%d) wanted %s %t, got %s %t", i, test.Type, test.OK, typ, ok)
+		}
+	}
+}